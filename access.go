@@ -0,0 +1,51 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+// With -access-log every connection gets one line when it is closed, no
+// matter it reached the relay phase or not.
+
+type accessEntry struct {
+	logEntry
+	DialTime float64 `json:"dial_time"` // in seconds
+	Duration float64 `json:"duration"`  // in seconds
+	Upload   uint64  `json:"upload"`
+	Download uint64  `json:"download"`
+}
+
+func formatAccess(s *session) []byte {
+	line, _ := json.Marshal(accessEntry{
+		logEntry: newLogEntry("info", s, s.code, "Access"),
+		DialTime: s.dialTime.Seconds(),
+		Duration: time.Since(s.start).Seconds(),
+		Upload:   atomic.LoadUint64(&s.upload),
+		Download: atomic.LoadUint64(&s.download),
+	})
+	return line
+}
+
+func (s *session) accessLog() {
+	if isTest {
+		return
+	}
+	if cfgLogFormat == "json" {
+		jsonLog.Print(string(formatAccess(s)))
+		return
+	}
+	code, target := string(s.code), s.target
+	if code == "" {
+		code = "-"
+	}
+	if target == "" {
+		target = "-"
+	}
+	log.Printf("conn#%d Access %s -> %s code=%s dial=%s upload=%d download=%d duration=%s",
+		s.id, s.client, target, code, s.dialTime,
+		atomic.LoadUint64(&s.upload), atomic.LoadUint64(&s.download),
+		time.Since(s.start))
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net"
+	"time"
+)
+
+// With -backend-ack the gateway waits for every target server to send one
+// byte, -backend-ack-byte, after the connection and the PROXY header of
+// -backend-proxy-protocol. An address pointing at some unrelated service
+// fails like a refused dial instead of relaying garbage both ways. Pooled and
+// multiplexed connections are shared or dialed ahead, so they can't be used
+// with it.
+
+var errBackendAck = errors.New("target server sent a wrong ack")
+
+// backendAck reads the ack byte of target server before the deadline.
+func backendAck(agent net.Conn, deadline time.Time) error {
+	var b [1]byte
+	agent.SetReadDeadline(deadline)
+	_, err := io.ReadFull(agent, b[:])
+	agent.SetReadDeadline(time.Time{})
+	if err == nil && b[0] != byte(cfgAckByte) {
+		err = errBackendAck
+	}
+	return err
+}
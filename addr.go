@@ -0,0 +1,68 @@
+package main
+
+import (
+	"net"
+	"strings"
+)
+
+// addrIP returns the IP part of a client address. IPv4 clients of a dual-stack
+// listener show up as IPv4-mapped IPv6 addresses (::ffff:1.2.3.4), they are
+// unmapped so the result always compares and keys the same way.
+func addrIP(a net.Addr) (net.IP, error) {
+	var ip net.IP
+	if ta, ok := a.(*net.TCPAddr); ok {
+		ip = ta.IP
+	} else {
+		addr := a.String()
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		if ip = net.ParseIP(host); ip == nil {
+			return nil, &net.AddrError{Err: "invalid IP address", Addr: addr}
+		}
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4, nil
+	}
+	return ip, nil
+}
+
+// parseCIDRs parses a comma separated CIDR list, a bare IP is treated as a
+// single host network.
+func parseCIDRs(list string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, item := range strings.Split(list, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		if !strings.Contains(item, "/") {
+			ip := net.ParseIP(item)
+			if ip == nil {
+				return nil, &net.ParseError{Type: "IP address", Text: item}
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipnet, err := net.ParseCIDR(item)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, ipnet)
+	}
+	return nets, nil
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, ipnet := range nets {
+		if ipnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
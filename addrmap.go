@@ -0,0 +1,73 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"sync/atomic"
+)
+
+// addrMap holds the map[string]string of -addr-map, logical names clients
+// have encrypted to the real target server addresses. Like the passphrase it
+// is replaced as a whole on reload.
+var addrMap atomic.Value
+
+var errUnmapped = errors.New("target server name not in address map")
+
+// loadAddrMap reads "name=host:port" lines of -addr-map, blank lines and
+// lines starting with # are skipped. A name can map to a comma separated
+// list of candidates.
+func loadAddrMap() error {
+	data, err := ioutil.ReadFile(cfgAddrMap)
+	if err != nil {
+		return err
+	}
+	m := make(map[string]string)
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		eq := strings.IndexByte(line, '=')
+		if eq < 0 {
+			return fmt.Errorf("line %d: want name=host:port", i+1)
+		}
+		name, addr := strings.TrimSpace(line[:eq]), strings.TrimSpace(line[eq+1:])
+		if name == "" || addr == "" {
+			return fmt.Errorf("line %d: want name=host:port", i+1)
+		}
+		m[name] = addr
+	}
+	addrMap.Store(m)
+	return nil
+}
+
+func mappedAddr(name string) (string, bool) {
+	m, _ := addrMap.Load().(map[string]string)
+	addr, ok := m[name]
+	return addr, ok
+}
+
+// mapTargets replaces the names in -addr-map with their addresses, other
+// candidates are dialed as they are unless -strict-map is set.
+func mapTargets(candidates []string) ([]string, error) {
+	if cfgAddrMap == "" {
+		return candidates, nil
+	}
+	targets := make([]string, 0, len(candidates))
+	for _, name := range candidates {
+		addr, ok := mappedAddr(name)
+		if !ok {
+			if cfgStrictMap {
+				return nil, errUnmapped
+			}
+			targets = append(targets, name)
+			continue
+		}
+		for _, item := range strings.Split(addr, ",") {
+			targets = append(targets, strings.TrimSpace(item))
+		}
+	}
+	return targets, nil
+}
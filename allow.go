@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	allowNets  []*net.IPNet
+	allowPorts [][2]int // inclusive ranges
+	allowUnix  map[string]bool
+
+	errForbidden = errors.New("target server not allowed")
+)
+
+func setupAllow() (err error) {
+	if allowNets, err = parseCIDRs(cfgAllowCIDR); err != nil {
+		return
+	}
+	if allowPorts, err = parsePorts(cfgAllowPorts); err != nil {
+		return
+	}
+	allowUnix = map[string]bool{}
+	for _, path := range strings.Split(cfgAllowUnix, ",") {
+		if path = strings.TrimSpace(path); path != "" {
+			allowUnix[path] = true
+		}
+	}
+	return
+}
+
+// unixScheme marks a target server address as a Unix domain socket path,
+// like "unix:/var/run/app.sock".
+const unixScheme = "unix:"
+
+func unixPath(addr string) (string, bool) {
+	if strings.HasPrefix(addr, unixScheme) {
+		return addr[len(unixScheme):], true
+	}
+	return "", false
+}
+
+// parsePorts parses a comma separated list of ports and port ranges, like
+// "80,443,8000-8100".
+func parsePorts(list string) ([][2]int, error) {
+	var ports [][2]int
+	for _, item := range strings.Split(list, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		lo, hi := item, item
+		if i := strings.IndexByte(item, '-'); i >= 0 {
+			lo, hi = item[:i], item[i+1:]
+		}
+		from, err1 := strconv.ParseUint(lo, 10, 16)
+		to, err2 := strconv.ParseUint(hi, 10, 16)
+		if err1 != nil || err2 != nil || from > to {
+			return nil, &net.ParseError{Type: "port range", Text: item}
+		}
+		ports = append(ports, [2]int{int(from), int(to)})
+	}
+	return ports, nil
+}
+
+// allowTargets checks the decrypted target server addresses against
+// -allow-cidr and -allow-ports, so a leaked passphrase doesn't turn the
+// gateway into an open relay. Hostnames are resolved here and every IP must
+// be allowed; the IPs are returned to be dialed, so a second lookup can't
+// point somewhere else. Unix sockets are only allowed by -allow-unix.
+func allowTargets(ctx context.Context, candidates []string) ([]string, error) {
+	for _, addr := range candidates {
+		if path, ok := unixPath(addr); ok && !allowUnix[path] {
+			return nil, errForbidden
+		}
+	}
+	if len(allowNets) == 0 && len(allowPorts) == 0 {
+		return candidates, nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(cfgDialTimeout))
+	defer cancel()
+
+	var targets []string
+	for _, addr := range candidates {
+		if _, ok := unixPath(addr); ok {
+			targets = append(targets, addr)
+			continue
+		}
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		if len(allowPorts) > 0 && !allowPort(port) {
+			return nil, errForbidden
+		}
+		if len(allowNets) == 0 {
+			targets = append(targets, addr)
+			continue
+		}
+		ips, err := lookupHost(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		for _, ip := range ips {
+			if !containsIP(allowNets, ip) {
+				return nil, errForbidden
+			}
+			targets = append(targets, net.JoinHostPort(ip.String(), port))
+		}
+	}
+	return targets, nil
+}
+
+// lookupHost resolves the host of a target server address for the checks
+// before dial, an IP is returned as is. IPv4 ones are in the 4 byte form.
+func lookupHost(ctx context.Context, host string) ([]net.IP, error) {
+	var ips []net.IP
+	if ip := net.ParseIP(host); ip != nil {
+		ips = []net.IP{ip}
+	} else {
+		addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		for _, a := range addrs {
+			ips = append(ips, a.IP)
+		}
+	}
+	for i, ip := range ips {
+		if ip4 := ip.To4(); ip4 != nil {
+			ips[i] = ip4
+		}
+	}
+	return ips, nil
+}
+
+func allowPort(port string) bool {
+	n, err := strconv.Atoi(port)
+	if err != nil {
+		return false
+	}
+	for _, r := range allowPorts {
+		if n >= r[0] && n <= r[1] {
+			return true
+		}
+	}
+	return false
+}
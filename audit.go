@@ -0,0 +1,56 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+)
+
+var audit struct {
+	sync.Mutex
+	file *os.File
+}
+
+type auditEntry struct {
+	Time   string            `json:"time"`
+	Source string            `json:"source"`
+	Action string            `json:"action"`
+	Params map[string]string `json:"params,omitempty"`
+	Result string            `json:"result"`
+}
+
+func setupAudit() error {
+	f, err := os.OpenFile(cfgAuditLog, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	audit.file = f
+	return nil
+}
+
+// auditf records an administrative action as a line of JSON. The file is not
+// buffered, every entry reaches the OS before auditf returns.
+func auditf(source, action string, params map[string]string, result string) {
+	if audit.file == nil {
+		return
+	}
+	line, err := json.Marshal(auditEntry{
+		Time:   time.Now().Format(time.RFC3339Nano),
+		Source: source,
+		Action: action,
+		Params: params,
+		Result: result,
+	})
+	if err != nil {
+		printf("Audit failed: %s", err)
+		return
+	}
+	line = append(line, '\n')
+
+	audit.Lock()
+	defer audit.Unlock()
+	if _, err := audit.file.Write(line); err != nil {
+		printf("Audit failed: %s", err)
+	}
+}
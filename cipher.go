@@ -0,0 +1,101 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+
+	"github.com/funny/crypto/aes256cbc"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// addrCipher encrypts target server addresses for clients, -cipher picks one
+// of addrCiphers. Every cipher starts its output with a different magic, data
+// of another cipher never decrypts.
+type addrCipher interface {
+	Encrypt(passphrase, plaintext []byte) ([]byte, error)
+	Decrypt(passphrase, data []byte) ([]byte, error)
+	DecryptBase64(passphrase, data []byte) ([]byte, error)
+}
+
+var (
+	addrCiphers = map[string]addrCipher{
+		"aes-256-cbc":       aesCBC{},
+		"chacha20-poly1305": chachaPoly{},
+	}
+	gatewayCipher addrCipher = aesCBC{}
+)
+
+func setupCipher() error {
+	c, ok := addrCiphers[cfgCipher]
+	if !ok {
+		return fmt.Errorf("unknown cipher %q", cfgCipher)
+	}
+	gatewayCipher = c
+	return nil
+}
+
+// aesCBC is the OpenSSL compatible format, "Salted__" + salt + ciphertext,
+// which "openssl enc -aes-256-cbc" produces.
+type aesCBC struct{}
+
+func (aesCBC) Encrypt(passphrase, plaintext []byte) ([]byte, error) {
+	return aes256cbc.Encrypt(passphrase, plaintext)
+}
+
+func (aesCBC) Decrypt(passphrase, data []byte) ([]byte, error) {
+	return aes256cbc.Decrypt(passphrase, data)
+}
+
+func (aesCBC) DecryptBase64(passphrase, data []byte) ([]byte, error) {
+	return aes256cbc.DecryptBase64(passphrase, data)
+}
+
+// chachaPoly is "CC20" + nonce + ciphertext and tag, the key is SHA-256 of
+// the passphrase. Unlike CBC a wrong passphrase or tampered data always
+// fails to decrypt instead of giving garbage.
+type chachaPoly struct{}
+
+var (
+	chachaMagic    = []byte("CC20")
+	errChachaMagic = errors.New("not chacha20-poly1305 data")
+)
+
+func (chachaPoly) Encrypt(passphrase, plaintext []byte) ([]byte, error) {
+	key := sha256.Sum256(passphrase)
+	aead, err := chacha20poly1305.New(key[:])
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, chacha20poly1305.NonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	out := make([]byte, 0, len(chachaMagic)+len(nonce)+len(plaintext)+aead.Overhead())
+	out = append(append(out, chachaMagic...), nonce...)
+	return aead.Seal(out, nonce, plaintext, chachaMagic), nil
+}
+
+func (chachaPoly) Decrypt(passphrase, data []byte) ([]byte, error) {
+	header := len(chachaMagic) + chacha20poly1305.NonceSize
+	if len(data) < header || string(data[:len(chachaMagic)]) != string(chachaMagic) {
+		return nil, errChachaMagic
+	}
+	key := sha256.Sum256(passphrase)
+	aead, err := chacha20poly1305.New(key[:])
+	if err != nil {
+		return nil, err
+	}
+	return aead.Open(nil, data[len(chachaMagic):header], data[header:], chachaMagic)
+}
+
+func (c chachaPoly) DecryptBase64(passphrase, data []byte) ([]byte, error) {
+	raw := make([]byte, base64.StdEncoding.DecodedLen(len(data)))
+	n, err := base64.StdEncoding.Decode(raw, data)
+	if err != nil {
+		return nil, err
+	}
+	return c.Decrypt(passphrase, raw[:n])
+}
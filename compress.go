@@ -0,0 +1,38 @@
+package main
+
+import (
+	"compress/flate"
+	"io"
+)
+
+// With -compress a client can ask for the client side of the tunnel to be
+// deflate (RFC 1951) compressed, by setting compressFlag in the version byte
+// of a versioned handshake. The version byte of the response has the flag
+// too if the gateway agreed. Everything after it is a deflate stream in
+// both directions, data to and from the target server stays as it is.
+const compressFlag = 0x40
+
+// deflateWriter compresses data relayed to the client.
+type deflateWriter struct {
+	zw *flate.Writer
+}
+
+func newDeflateWriter(w io.Writer) *deflateWriter {
+	zw, _ := flate.NewWriter(w, flate.BestSpeed)
+	return &deflateWriter{zw}
+}
+
+// Write flushes every write, so the client gets data as soon as the target
+// server sent it instead of when a deflate block is full.
+func (dw *deflateWriter) Write(p []byte) (int, error) {
+	n, err := dw.zw.Write(p)
+	if err == nil {
+		err = dw.zw.Flush()
+	}
+	return n, err
+}
+
+// Close ends the deflate stream, the client reads EOF of it after the data.
+func (dw *deflateWriter) Close() error {
+	return dw.zw.Close()
+}
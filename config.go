@@ -0,0 +1,51 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+)
+
+// loadConfig sets flags from a JSON file of -config, keys are the flag names
+// without "-", like {"secret": "...", "retry": 3}. Flags given on the command
+// line take precedence over the file.
+func loadConfig(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var values map[string]interface{}
+	if err := json.Unmarshal(data, &values); err != nil {
+		return err
+	}
+
+	explicit := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = true
+	})
+	for name, value := range values {
+		if flag.Lookup(name) == nil || name == "config" {
+			return fmt.Errorf("unknown key %q", name)
+		}
+		if explicit[name] {
+			continue
+		}
+		var s string
+		switch v := value.(type) {
+		case string:
+			s = v
+		case bool:
+			s = strconv.FormatBool(v)
+		case float64:
+			s = strconv.FormatFloat(v, 'f', -1, 64)
+		default:
+			return fmt.Errorf("bad value of %q: %v", name, value)
+		}
+		if err := flag.Set(name, s); err != nil {
+			return fmt.Errorf("bad value of %q: %s", name, err)
+		}
+	}
+	return nil
+}
@@ -2,11 +2,22 @@
 
 package main
 
-import "io"
+import (
+	"io"
+	"sync"
+)
 
-func copy(dst io.WriteCloser, src io.ReadCloser) {
-	b := copyBufPool.Get().(*[]byte)
+// copy relays src to dst through a buffer of pool. src is wrapped to hide
+// io.WriterTo, the WriteTo of *net.TCPConn would copy through a 32KB buffer
+// of its own instead. Between TCP connections on Linux the data is spliced,
+// see spliceCopy().
+func copy(dst io.Writer, src io.Reader, n, total *uint64, pool *sync.Pool) error {
+	if handled, err := spliceCopy(dst, src, n, total); handled {
+		return err
+	}
+	b := pool.Get().(*[]byte)
 	buf := *b
-	io.CopyBuffer(dst, src, buf)
-	copyBufPool.Put(b)
+	_, err := io.CopyBuffer(countWriter{dst, n, total}, struct{ io.Reader }{src}, buf)
+	pool.Put(b)
+	return err
 }
@@ -2,8 +2,12 @@
 
 package main
 
-import "io"
+import (
+	"io"
+	"sync"
+)
 
-func copy(dst io.WriteCloser, src io.ReadCloser) {
-	io.Copy(dst, src)
+func copy(dst io.Writer, src io.Reader, n, total *uint64, pool *sync.Pool) error {
+	_, err := io.Copy(countWriter{dst, n, total}, src)
+	return err
 }
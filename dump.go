@@ -0,0 +1,39 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"runtime/pprof"
+	"time"
+)
+
+// writeDump writes a goroutine stack dump, and a heap profile if -dump-heap
+// is set, into -dump-dir. It's best effort and never crashes the gateway.
+func writeDump() {
+	defer func() {
+		if err := recover(); err != nil {
+			printf("Dump failed: %v\n\n%s", err, debug.Stack())
+		}
+	}()
+
+	stamp := time.Now().Format("20060102-150405")
+	writeProfile("goroutine", filepath.Join(cfgDumpDir, "gateway-goroutine-"+stamp+".txt"), 2)
+	if cfgDumpHeap {
+		writeProfile("heap", filepath.Join(cfgDumpDir, "gateway-heap-"+stamp+".pprof"), 0)
+	}
+}
+
+func writeProfile(name, path string, level int) {
+	f, err := os.Create(path)
+	if err != nil {
+		printf("Dump %s failed: %s", name, err)
+		return
+	}
+	defer f.Close()
+	if err := pprof.Lookup(name).WriteTo(f, level); err != nil {
+		printf("Dump %s failed: %s", name, err)
+		return
+	}
+	printf("Dump %s to %s", name, path)
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// With -log-handshake-failures failed handshakes are logged with the client
+// IP and the reason. Only the first failure of an IP in every
+// -handshake-failure-interval is logged, the others are in a summary line at
+// the end of the interval, so an attacker can't flood the log.
+
+// maxFailureIPs bounds the IPs remembered in an interval, failures of more
+// IPs are only counted.
+const maxFailureIPs = 10000
+
+var failureLog = struct {
+	sync.Mutex
+	ips      map[string]int // failures of every IP in this interval
+	unlisted int            // failures of IPs beyond maxFailureIPs
+	total    int
+}{ips: make(map[string]int)}
+
+// logFailure records a failed handshake, true means it has been logged.
+func logFailure(s *session, reason string) bool {
+	if !cfgLogFailures {
+		return false
+	}
+	ip := clientIP(s.client)
+
+	failureLog.Lock()
+	failureLog.total++
+	n, ok := failureLog.ips[ip]
+	if !ok && len(failureLog.ips) >= maxFailureIPs {
+		failureLog.unlisted++
+		failureLog.Unlock()
+		return false
+	}
+	failureLog.ips[ip] = n + 1
+	failureLog.Unlock()
+
+	if n > 0 {
+		return false
+	}
+	s.logf("warn", s.code, "Handshake from %s failed: %s", ip, reason)
+	return true
+}
+
+// failureSummary returns the failures and the IPs they came from since the
+// last call, and starts a new interval. IPs beyond maxFailureIPs are counted
+// once per failure.
+func failureSummary() (total, ips int) {
+	failureLog.Lock()
+	defer failureLog.Unlock()
+	total = failureLog.total
+	ips = len(failureLog.ips) + failureLog.unlisted
+	failureLog.ips = make(map[string]int)
+	failureLog.unlisted = 0
+	failureLog.total = 0
+	return
+}
+
+func summarizeFailures() {
+	for range time.Tick(time.Duration(cfgFailWindow)) {
+		if total, ips := failureSummary(); total > 0 {
+			logLine("warn", nil, nil, fmt.Sprintf("%d handshake failures from %d IPs in the last %s", total, ips, time.Duration(cfgFailWindow)))
+		}
+	}
+}
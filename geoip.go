@@ -0,0 +1,105 @@
+package main
+
+import (
+	"expvar"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+var (
+	geoipMutex   sync.RWMutex
+	geoipDB      geoipReader
+	geoipBlocked map[string]bool
+
+	geoipAccept = expvar.NewMap("geoip_accept")
+	geoipReject = expvar.NewMap("geoip_reject")
+)
+
+// geoipReader is what the gateway uses of *maxminddb.Reader, tests put a
+// fixed table in its place.
+type geoipReader interface {
+	Lookup(ip net.IP, result interface{}) error
+	Close() error
+}
+
+type geoipRecord struct {
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+}
+
+// loadGeoIP opens the database and swaps it with the current one.
+// The old database is closed after all running lookups returned.
+func loadGeoIP() error {
+	db, err := maxminddb.Open(cfgGeoIPPath)
+	if err != nil {
+		return err
+	}
+
+	blocked := make(map[string]bool)
+	for _, code := range strings.Split(cfgGeoIPBlock, ",") {
+		if code = strings.ToUpper(strings.TrimSpace(code)); code != "" {
+			blocked[code] = true
+		}
+	}
+
+	geoipMutex.Lock()
+	old := geoipDB
+	geoipDB = db
+	geoipBlocked = blocked
+	geoipMutex.Unlock()
+
+	if old != nil {
+		old.Close()
+	}
+	return nil
+}
+
+func geoipAllow(client net.Addr) bool {
+	if cfgGeoIPPath == "" {
+		return true
+	}
+
+	country, err := geoipCountry(client)
+	if err != nil {
+		if cfgGeoIPOpen {
+			geoipAccept.Add("error", 1)
+			return true
+		}
+		geoipReject.Add("error", 1)
+		return false
+	}
+	if country == "" {
+		country = "unknown"
+	}
+
+	geoipMutex.RLock()
+	blocked := geoipBlocked[country]
+	geoipMutex.RUnlock()
+
+	if blocked {
+		geoipReject.Add(country, 1)
+		return false
+	}
+	geoipAccept.Add(country, 1)
+	return true
+}
+
+func geoipCountry(client net.Addr) (string, error) {
+	ip, err := addrIP(client)
+	if err != nil {
+		return "", err
+	}
+
+	var record geoipRecord
+	geoipMutex.RLock()
+	err = geoipDB.Lookup(ip, &record)
+	geoipMutex.RUnlock()
+	if err != nil {
+		return "", err
+	}
+	return record.Country.ISOCode, nil
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// healthCache is how long a -health-backend check result is reused, so load
+// balancers polling /healthz don't turn into dials to the backend.
+const healthCache = time.Second
+
+var health struct {
+	sync.Mutex
+	checked time.Time
+	err     error
+}
+
+func init() {
+	http.HandleFunc("/healthz", healthHandler)
+}
+
+// backendHealth dials -health-backend at most once per healthCache, polls in
+// between get the last result.
+func backendHealth() error {
+	health.Lock()
+	defer health.Unlock()
+	if time.Since(health.checked) < healthCache {
+		return health.err
+	}
+	agent, err := dial(context.Background(), cfgHealthAddr)
+	if err == nil {
+		agent.Close()
+	}
+	health.checked, health.err = time.Now(), err
+	return err
+}
+
+// healthHandler returns 200 while the gateway is accepting connections, and
+// 503 before that, during shutdown or when -health-backend is unreachable.
+func healthHandler(w http.ResponseWriter, r *http.Request) {
+	if atomic.LoadInt32(&ready) == 0 {
+		http.Error(w, "not ready", http.StatusServiceUnavailable)
+		return
+	}
+	if atomic.LoadInt32(&closing) == 1 {
+		http.Error(w, "shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	if cfgHealthAddr != "" {
+		if err := backendHealth(); err != nil {
+			// the address and the error only go to the log, not to whoever
+			// polls /healthz
+			logLine("warn", nil, nil, fmt.Sprintf("Health backend %s unreachable: %s", cfgHealthAddr, err))
+			http.Error(w, "backend unreachable", http.StatusServiceUnavailable)
+			return
+		}
+	}
+	w.Write([]byte("ok\n"))
+}
@@ -4,13 +4,33 @@ package main
 
 import (
 	"net"
+	"os"
+	"syscall"
 
 	"github.com/funny/reuseport"
 )
 
-func listen() (net.Listener, error) {
+// canReusePort reports whether -reuse can open more listeners on one port.
+const canReusePort = true
+
+// listen opens a listener, with SO_REUSEPORT if -reuse is set. A kernel
+// without SO_REUSEPORT turns -reuse off, so the gateway still starts with a
+// plain listener.
+func listen(addr string) (net.Listener, error) {
 	if cfgReusePort {
-		return reuseport.NewReusablePortListener("tcp", cfgGatewayAddr)
+		listener, err := reuseport.NewReusablePortListener(cfgNetwork, addr)
+		if err == nil || !reusePortUnsupported(err) {
+			return listener, err
+		}
+		printf("Reuse port not supported, use one listener: %s", err)
+		cfgReusePort = false
+	}
+	return net.Listen(cfgNetwork, addr)
+}
+
+func reusePortUnsupported(err error) bool {
+	if se, ok := err.(*os.SyscallError); ok {
+		err = se.Err
 	}
-	return net.Listen("tcp", cfgGatewayAddr)
+	return err == syscall.ENOPROTOOPT || err == syscall.EOPNOTSUPP || err == syscall.EINVAL
 }
@@ -0,0 +1,19 @@
+// +build linux darwin dragonfly freebsd netbsd openbsd
+
+package main
+
+import (
+	"errors"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/funny/utest"
+)
+
+func Test_ReusePortUnsupported(t *testing.T) {
+	utest.Assert(t, reusePortUnsupported(syscall.ENOPROTOOPT))
+	utest.Assert(t, reusePortUnsupported(os.NewSyscallError("setsockopt", syscall.ENOPROTOOPT)))
+	utest.Assert(t, !reusePortUnsupported(syscall.EADDRINUSE))
+	utest.Assert(t, !reusePortUnsupported(errors.New("other")))
+}
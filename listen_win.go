@@ -4,6 +4,9 @@ package main
 
 import "net"
 
-func listen() (net.Listener, error) {
-	return net.Listen("tcp", cfgGatewayAddr)
+// canReusePort reports whether -reuse can open more listeners on one port.
+const canReusePort = false
+
+func listen(addr string) (net.Listener, error) {
+	return net.Listen(cfgNetwork, addr)
 }
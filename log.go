@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"time"
+)
+
+// With -log-format json every log line is a JSON object, and lines about a
+// connection carry its id and addresses as fields instead of in the text.
+
+var jsonLog = log.New(os.Stderr, "", 0)
+
+type logEntry struct {
+	Time        string `json:"time"`
+	Level       string `json:"level"`
+	Msg         string `json:"msg"`
+	ConnID      uint64 `json:"conn_id,omitempty"`
+	RemoteAddr  string `json:"remote_addr,omitempty"`
+	ClientIP    string `json:"client_ip,omitempty"`
+	BackendAddr string `json:"backend_addr,omitempty"`
+	Tenant      string `json:"tenant,omitempty"`
+	Code        string `json:"code,omitempty"`
+}
+
+func newLogEntry(level string, s *session, code []byte, msg string) logEntry {
+	entry := logEntry{
+		Time:  time.Now().Format(time.RFC3339Nano),
+		Level: level,
+		Msg:   msg,
+		Code:  string(code),
+	}
+	if s != nil {
+		entry.ConnID = s.id
+		entry.RemoteAddr = s.client.String()
+		entry.ClientIP = clientIP(s.client)
+		entry.BackendAddr = s.target
+		entry.Tenant = s.tenant
+	}
+	return entry
+}
+
+// clientIP is the IP of a client address without the port, so abuse reports
+// can be matched by IP. Addresses without a port are kept whole.
+func clientIP(addr net.Addr) string {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
+
+func formatLog(level string, s *session, code []byte, msg string) []byte {
+	line, _ := json.Marshal(newLogEntry(level, s, code, msg))
+	return line
+}
+
+func logLine(level string, s *session, code []byte, msg string) {
+	if isTest {
+		return
+	}
+	if cfgLogFormat == "json" {
+		jsonLog.Print(string(formatLog(level, s, code, msg)))
+		return
+	}
+	if s != nil {
+		msg = fmt.Sprintf("conn#%d %s", s.id, msg)
+	}
+	log.Print(msg)
+}
+
+// logf logs about the session, code is the one sent to client if any.
+func (s *session) logf(level string, code []byte, t string, args ...interface{}) {
+	logLine(level, s, code, fmt.Sprintf(t, args...))
+}
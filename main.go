@@ -2,64 +2,254 @@ package main
 
 import (
 	"bytes"
+	"compress/flate"
+	"context"
+	"crypto/tls"
 	"flag"
 	"fmt"
-	"io/ioutil"
-	"log"
+	"io"
+	"math/rand"
 	"net"
 	"net/http"
 	_ "net/http/pprof"
 	"os"
-	"os/signal"
+	"runtime"
 	"runtime/debug"
 	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
-
-	"github.com/funny/crypto/aes256cbc"
 )
 
-const miniBufferSize = 1024
+const (
+	miniBufferSize       = 1024
+	defaultHandshakeSize = 64 /* longest crypted address */ + 1 /* \n */
+
+	// shortest crypted address and \n, a smaller -handshake fits no address
+	minHandshakeSize = 44 + 1
+)
 
 var (
 	configed       = false
+	cfgConfigFile  = ""
 	cfgSecret      []byte
 	cfgGatewayAddr = "0.0.0.0:0"
+	cfgNetwork     = "tcp"
 	cfgPprofAddr   = ""
 	cfgReusePort   = false
+	cfgAcceptLoops = uint(0)
 	cfgDialRetry   = uint(1)
 	cfgDialTimeout = uint(3)
+	cfgDialBackoff = uint(0)
+	cfgAgentWrite  = uint(0)
+	cfgCodeWrite   = uint(1000)
 	cfgBufferSize  = uint(16 * 1024)
+	cfgBufferLimit = uint(0)
+	cfgHandshake   = uint(defaultHandshakeSize)
+	cfgLinger      = -1
+	cfgKeepAlive   = -1
+	cfgNoDelay     = true
+	cfgDialProbe   = uint(0)
+	cfgBackendAck  = false
+	cfgAckByte     = uint(0x06)
+	cfgAckTimeout  = uint(1000)
+	cfgWriteStall  = uint(0)
+	cfgTFOServer   = false
+	cfgTFOClient   = false
+	cfgGeoIPPath   = ""
+	cfgGeoIPBlock  = ""
+	cfgGeoIPOpen   = true
+	cfgMaintenance = false
+	cfgMaintAllow  = ""
+	cfgRetryMaint  = uint(0)
+	cfgProxyProto  = false
+	cfgWaitTargets = ""
+	cfgWaitTimeout = uint(30)
+	cfgHealthAddr  = ""
+	cfgStatsdAddr  = ""
+	cfgIdleExit    = uint(0)
+	cfgMux         = false
+	cfgMuxConns    = uint(1)
+	cfgPoolSize    = uint(0)
+	cfgPoolIdle    = uint(30)
+	cfgDumpDir     = "."
+	cfgDumpHeap    = false
+	cfgMaxPending  = uint(0)
+	cfgAuditLog    = ""
+	cfgPidFile     = "gateway.pid"
+	cfgCheckOnly   = false
+	cfgPoll        = false
+	cfgSetupBudget = uint(0)
+	cfgStopTimeout = uint(30)
+	cfgIdleTimeout = uint(0)
+	cfgMaxBytes    = uint64(0)
+	cfgMaxLife     = uint(0)
+	cfgMaxConns    = uint(0)
+	cfgFullReject  = false
+	cfgRetryFull   = uint(0)
+	cfgAgentProxy  = false
+	cfgSecretFile  = ""
+	cfgSecretOld   []byte
+	cfgTenants     = ""
+	cfgCipher      = "aes-256-cbc"
+	cfgRequireMAC  = false
+	cfgAllowCIDR   = ""
+	cfgAllowPorts  = ""
+	cfgAllowUnix   = ""
+	cfgAddrMap     = ""
+	cfgStrictMap   = false
+	cfgBlockSelf   = false
+	cfgTLSCert     = ""
+	cfgTLSKey      = ""
+	cfgTLSMin      = "1.2"
+	cfgUDP         = false
+	cfgSOCKS       = false
+	cfgCompress    = false
+	cfgUpSOCKS     = ""
+	cfgAddrTimeout = uint(0)
+	cfgMinRate     = uint(0)
+	cfgLogFormat   = "text"
+	cfgAccessLog   = false
+	cfgVerboseCode = false
+	cfgRateLimit   = uint(0)
+	cfgRateBurst   = uint(0)
+	cfgLogFailures = false
+	cfgFailWindow  = uint(60)
 
 	codeOK          = []byte("200")
 	codeBadReq      = []byte("400")
 	codeBadAddr     = []byte("401")
 	codeDialErr     = []byte("502")
 	codeDialTimeout = []byte("504")
+	codeUnavailable = []byte("503")
+	codeForbidden   = []byte("403")
+	codeInternal    = []byte("500")
+	codeSelfLoop    = []byte("508")
 
 	isTest           bool
 	handshakeBufPool sync.Pool
 	copyBufPool      sync.Pool
+	miniCopyBufPool  sync.Pool
 )
 
 func init() {
-	var secret string
+	var secret, secretOld string
+	flag.StringVar(&cfgConfigFile, "config", cfgConfigFile, "JSON file of settings keyed by flag names, command line flags take precedence")
 	flag.StringVar(&secret, "secret", "", "The passphrase used to decrypt target server address")
+	flag.StringVar(&secretOld, "secret-old", "", "Previous passphrase still accepted during rotation when decrypt with -secret failed")
 	flag.StringVar(&cfgGatewayAddr, "addr", cfgGatewayAddr, "Network address for gateway")
-	flag.StringVar(&cfgPprofAddr, "pprof", cfgPprofAddr, "Network address for net/http/pprof")
+	flag.StringVar(&cfgNetwork, "network", cfgNetwork, "Network of -addr: tcp for dual-stack, tcp4 or tcp6")
+	flag.StringVar(&cfgPprofAddr, "pprof", cfgPprofAddr, "Network address for net/http/pprof, or unix:/path of a Unix socket")
 	flag.BoolVar(&cfgReusePort, "reuse", cfgReusePort, "Enable reuse port feature")
+	flag.UintVar(&cfgAcceptLoops, "accept-loops", cfgAcceptLoops, "Listeners and accept loops opened with -reuse, 0 means GOMAXPROCS")
 	flag.UintVar(&cfgDialRetry, "retry", cfgDialRetry, "Retry times when dial to target server timeout")
 	flag.UintVar(&cfgDialTimeout, "timeout", cfgDialTimeout, "Timeout seconds when dial to targer server")
+	flag.UintVar(&cfgAgentWrite, "backend-write-timeout", cfgAgentWrite, "Timeout seconds of writing PROXY header and buffered client data to target server, 0 means no limit")
+	flag.UintVar(&cfgCodeWrite, "code-write-timeout", cfgCodeWrite, "Timeout milliseconds of writing status codes to client, 0 means no limit")
+	flag.UintVar(&cfgDialBackoff, "retry-backoff", cfgDialBackoff, "Milliseconds to wait before the first retry, doubled for each next one, 0 means retry immediately")
 	flag.UintVar(&cfgBufferSize, "buffer", cfgBufferSize, "Buffer size for io.CopyBuffer()")
+	flag.UintVar(&cfgBufferLimit, "buffer-limit", cfgBufferLimit, "Active connections above which new connections get 1KB copy buffers, 0 means no limit")
+	flag.UintVar(&cfgHandshake, "handshake", cfgHandshake, "Max handshake length in bytes, including the trailing newline")
+	flag.UintVar(&cfgDialProbe, "probe", cfgDialProbe, "Milliseconds to wait for target server closing connection before send 200, 0 means disable")
+	flag.BoolVar(&cfgBackendAck, "backend-ack", cfgBackendAck, "Wait for target server to send -backend-ack-byte before send 200, a wrong byte or none is a dial failure")
+	flag.UintVar(&cfgAckByte, "backend-ack-byte", cfgAckByte, "The byte target server sends under -backend-ack")
+	flag.UintVar(&cfgAckTimeout, "backend-ack-timeout", cfgAckTimeout, "Milliseconds to wait for the byte of -backend-ack")
+	flag.UintVar(&cfgWriteStall, "write-stall", cfgWriteStall, "Seconds a write to client or target server can make no progress before the connection is closed as stalled, 0 means no limit")
+	flag.IntVar(&cfgLinger, "linger", cfgLinger, "SO_LINGER seconds for force-closed connections, 0 means reset immediately, -1 keeps system default")
+	flag.IntVar(&cfgKeepAlive, "keepalive", cfgKeepAlive, "TCP keepalive period seconds of client and target server connections, 0 means disable, -1 keeps Go default")
+	flag.BoolVar(&cfgNoDelay, "nodelay", cfgNoDelay, "Set TCP_NODELAY on client and target server connections, false enables Nagle's algorithm")
+	flag.BoolVar(&cfgTFOServer, "tfo-server", cfgTFOServer, "Enable TCP Fast Open on the gateway listener (Linux only)")
+	flag.BoolVar(&cfgTFOClient, "tfo-client", cfgTFOClient, "Enable TCP Fast Open when dial to target server (Linux only)")
+	flag.StringVar(&cfgGeoIPPath, "geoip", cfgGeoIPPath, "Path of MaxMind GeoIP2/GeoLite2 country database, reloaded on SIGHUP")
+	flag.StringVar(&cfgGeoIPBlock, "geoip-block", cfgGeoIPBlock, "Comma separated ISO country codes to reject, e.g. \"KP,IR\"")
+	flag.BoolVar(&cfgGeoIPOpen, "geoip-failopen", cfgGeoIPOpen, "Accept the connection when GeoIP lookup failed")
+	flag.BoolVar(&cfgMaintenance, "maintenance", cfgMaintenance, "Start in maintenance mode, toggle at runtime by POST /maintenance on pprof address")
+	flag.StringVar(&cfgMaintAllow, "maintenance-allow", cfgMaintAllow, "Comma separated client CIDRs still accepted in maintenance mode")
+	flag.UintVar(&cfgRetryMaint, "maintenance-retry", cfgRetryMaint, "Seconds of retry-after hint sent with 503 in maintenance mode, 0 means no hint")
+	flag.BoolVar(&cfgProxyProto, "proxy-protocol", cfgProxyProto, "Read PROXY protocol v1/v2 header sent by the load balancer in front of gateway")
+	flag.StringVar(&cfgWaitTargets, "wait-backend", cfgWaitTargets, "Comma separated target server addresses, gateway starts accepting after one of them is reachable")
+	flag.UintVar(&cfgWaitTimeout, "wait-timeout", cfgWaitTimeout, "Max seconds to wait for -wait-backend, gateway starts accepting anyway after that")
+	flag.StringVar(&cfgHealthAddr, "health-backend", cfgHealthAddr, "Target server address /healthz dials to, unhealthy if it's down")
+	flag.StringVar(&cfgStatsdAddr, "statsd", cfgStatsdAddr, "UDP address of statsd server, metrics are not sent when empty")
+	flag.UintVar(&cfgIdleExit, "idle-shutdown", cfgIdleExit, "Exit after there is no connection for this many seconds, 0 means never")
+	flag.BoolVar(&cfgMux, "mux", cfgMux, "Open yamux streams over shared connections instead of dial to target server for each client (experimental)")
+	flag.UintVar(&cfgMuxConns, "mux-conns", cfgMuxConns, "Max shared connections to each target server in -mux mode")
+	flag.StringVar(&cfgDumpDir, "dump-dir", cfgDumpDir, "Directory to write goroutine dump on SIGUSR1")
+	flag.BoolVar(&cfgDumpHeap, "dump-heap", cfgDumpHeap, "Also write heap profile on SIGUSR1")
+	flag.UintVar(&cfgMaxPending, "max-pending", cfgMaxPending, "Max connections in handshake at the same time, more are closed immediately, 0 means no limit")
+	flag.StringVar(&cfgAuditLog, "audit-log", cfgAuditLog, "File to append JSON audit entries of administrative actions")
+	flag.BoolVar(&cfgPoll, "poll", cfgPoll, "Copy both directions of all connections by a shared epoll goroutine, halves goroutines for idle connections (Linux only)")
+	flag.UintVar(&cfgSetupBudget, "setup-budget", cfgSetupBudget, "Total seconds for all dial retries and probe of a connection, 0 means no limit")
+	flag.UintVar(&cfgStopTimeout, "shutdown-timeout", cfgStopTimeout, "Max seconds to wait for active connections on SIGTERM/SIGINT before force close them")
+	flag.UintVar(&cfgIdleTimeout, "idle-timeout", cfgIdleTimeout, "Close the tunnel after no data in either direction for this many seconds, 0 means no limit")
+	flag.UintVar(&cfgMaxConns, "max-conns", cfgMaxConns, "Max connections handled at the same time, 0 means no limit")
+	flag.BoolVar(&cfgFullReject, "max-conns-reject", cfgFullReject, "Reject new connections with 503 above -max-conns instead of stop accepting")
+	flag.UintVar(&cfgRetryFull, "max-conns-retry", cfgRetryFull, "Seconds of retry-after hint sent with 503 above -max-conns, 0 means no hint")
+	flag.BoolVar(&cfgAgentProxy, "backend-proxy-protocol", cfgAgentProxy, "Send PROXY protocol v1 header with the client address to target server")
+	flag.StringVar(&cfgCipher, "cipher", cfgCipher, "Cipher of target server addresses: aes-256-cbc or chacha20-poly1305")
+	flag.BoolVar(&cfgRequireMAC, "require-hmac", cfgRequireMAC, "Require HMAC-SHA256 of the address ciphertext after it, checked before decrypt")
+	flag.StringVar(&cfgSecretFile, "secret-file", cfgSecretFile, "File of the passphrase, overrides -secret and reloaded on SIGHUP")
+	flag.StringVar(&cfgTenants, "tenant-secrets", cfgTenants, "Comma separated tenant=secret passphrases for \"tenant:ciphertext\" handshakes")
+	flag.StringVar(&cfgAllowCIDR, "allow-cidr", cfgAllowCIDR, "Comma separated CIDRs target servers must be in, hostnames are resolved before the check")
+	flag.StringVar(&cfgAllowPorts, "allow-ports", cfgAllowPorts, "Comma separated ports or ranges target servers must use, e.g. \"80,8000-8100\"")
+	flag.StringVar(&cfgAllowUnix, "allow-unix", cfgAllowUnix, "Comma separated Unix domain socket paths allowed as \"unix:/path\" target servers")
+	flag.StringVar(&cfgAddrMap, "addr-map", cfgAddrMap, "File of name=host:port lines, decrypted names are replaced before dial, reloaded on SIGHUP")
+	flag.BoolVar(&cfgStrictMap, "strict-map", cfgStrictMap, "Reject decrypted target server addresses not in -addr-map")
+	flag.BoolVar(&cfgBlockSelf, "block-self", cfgBlockSelf, "Reject target server addresses which lead back to the gateway itself")
+	flag.StringVar(&cfgTLSCert, "tls-cert", cfgTLSCert, "PEM certificate file, clients connect to gateway over TLS when set with -tls-key")
+	flag.StringVar(&cfgTLSKey, "tls-key", cfgTLSKey, "PEM private key file of -tls-cert")
+	flag.StringVar(&cfgTLSMin, "tls-min-version", cfgTLSMin, "Minimum TLS version accepted from clients: 1.0, 1.1, 1.2 or 1.3")
+	flag.BoolVar(&cfgSOCKS, "socks", cfgSOCKS, "Accept SOCKS5 CONNECT requests too, the password must be the secret")
+	flag.BoolVar(&cfgCompress, "compress", cfgCompress, "Compress the client side of tunnels for clients which ask for it")
+	flag.StringVar(&cfgUpSOCKS, "upstream-socks", cfgUpSOCKS, "Dial target servers through this SOCKS5 proxy, host:port or user:password@host:port")
+	flag.BoolVar(&cfgUDP, "udp", cfgUDP, "Allow \"udp://host:port\" target server addresses, datagrams are framed with 2 bytes length on client connection")
+	flag.UintVar(&cfgAddrTimeout, "handshake-timeout", cfgAddrTimeout, "Seconds a client has to send the handshake after connected, 0 means no limit")
+	flag.UintVar(&cfgMinRate, "handshake-min-rate", cfgMinRate, "Min bytes per second a client has to send the handshake at after the first second, 0 means no limit")
+	flag.Uint64Var(&cfgMaxBytes, "max-conn-bytes", cfgMaxBytes, "Max bytes a connection relays in both directions together, 0 means no limit")
+	flag.UintVar(&cfgMaxLife, "max-conn-duration", cfgMaxLife, "Max seconds a connection is relayed after handshake, 0 means no limit")
+	flag.UintVar(&cfgPoolSize, "pool-size", cfgPoolSize, "Experimental, connections dialed ahead to each target server, 0 means disable")
+	flag.UintVar(&cfgPoolIdle, "pool-idle", cfgPoolIdle, "Seconds a connection of -pool-size is kept before it's closed unused")
+	flag.StringVar(&cfgPidFile, "pid-file", cfgPidFile, "File to write the process id in, empty means not to write")
+	flag.BoolVar(&cfgCheckOnly, "check", cfgCheckOnly, "Validate the settings and exit, without listening or writing any file")
+	flag.StringVar(&cfgLogFormat, "log-format", cfgLogFormat, "Log format, text or json")
+	flag.BoolVar(&cfgAccessLog, "access-log", cfgAccessLog, "Log one line for every connection when it is closed")
+	flag.UintVar(&cfgRateLimit, "rate-limit", cfgRateLimit, "New connections per second allowed from each client IP, 0 means no limit")
+	flag.UintVar(&cfgRateBurst, "rate-burst", cfgRateBurst, "New connections a client IP can open at once under -rate-limit, 0 means the same as -rate-limit")
+	flag.BoolVar(&cfgLogFailures, "log-handshake-failures", cfgLogFailures, "Log failed handshakes with the client IP and reason, once per IP in every -handshake-failure-interval")
+	flag.UintVar(&cfgFailWindow, "handshake-failure-interval", cfgFailWindow, "Seconds between summaries of failed handshakes under -log-handshake-failures")
+	flag.BoolVar(&cfgVerboseCode, "verbose-codes", cfgVerboseCode, "Send a short reason after error codes, like \"502 connection refused\\n\"")
 	flag.Parse()
 
+	if cfgConfigFile != "" {
+		if err := loadConfig(cfgConfigFile); err != nil {
+			fatalf("Load config file failed: %s", err)
+		}
+	}
+
 	cfgSecret = []byte(secret)
+	cfgSecretOld = []byte(secretOld)
 
 	cfgDialTimeout = uint(time.Second) * cfgDialTimeout
+	cfgDialProbe = uint(time.Millisecond) * cfgDialProbe
+	cfgAckTimeout = uint(time.Millisecond) * cfgAckTimeout
+	cfgDialBackoff = uint(time.Millisecond) * cfgDialBackoff
+	cfgCodeWrite = uint(time.Millisecond) * cfgCodeWrite
+	cfgAgentWrite = uint(time.Second) * cfgAgentWrite
+	cfgWaitTimeout = uint(time.Second) * cfgWaitTimeout
+	cfgWriteStall = uint(time.Second) * cfgWriteStall
+	cfgIdleExit = uint(time.Second) * cfgIdleExit
+	cfgSetupBudget = uint(time.Second) * cfgSetupBudget
+	cfgStopTimeout = uint(time.Second) * cfgStopTimeout
+	cfgIdleTimeout = uint(time.Second) * cfgIdleTimeout
+	cfgMaxLife = uint(time.Second) * cfgMaxLife
+	cfgPoolIdle = uint(time.Second) * cfgPoolIdle
+	cfgAddrTimeout = uint(time.Second) * cfgAddrTimeout
+	cfgFailWindow = uint(time.Second) * cfgFailWindow
 
 	handshakeBufPool.New = func() interface{} {
-		buf := make([]byte, 64 /* longest crypted address */ +1 /* \n */)
+		buf := make([]byte, cfgHandshake)
 		return &buf
 	}
 
@@ -67,85 +257,327 @@ func init() {
 		buf := make([]byte, cfgBufferSize)
 		return &buf
 	}
+
+	miniCopyBufPool.New = func() interface{} {
+		buf := make([]byte, miniBufferSize)
+		return &buf
+	}
 }
 
 func main() {
-	if len(cfgSecret) == 0 {
+	if cfgLogFormat != "text" && cfgLogFormat != "json" {
+		fatalf("Unknown log format %q", cfgLogFormat)
+	}
+	if cfgHandshake < minHandshakeSize {
+		fatalf("Handshake length %d is shorter than any encrypted address, at least %d", cfgHandshake, minHandshakeSize)
+	}
+	if len(cfgSecret) == 0 && cfgSecretFile == "" && cfgTenants == "" {
 		fatal("Missing passphrase")
 		return
 	}
+	if err := loadSecret(); err != nil {
+		fatalf("Load passphrase failed: %s", err)
+	}
+	if err := setupCipher(); err != nil {
+		fatalf("Setup cipher failed: %s", err)
+	}
+	if err := setupTenants(); err != nil {
+		fatalf("Bad tenant secrets: %s", err)
+	}
+	if cfgAddrMap != "" {
+		if err := loadAddrMap(); err != nil {
+			fatalf("Load address map failed: %s", err)
+		}
+	}
+
+	if cfgGeoIPPath != "" {
+		if err := loadGeoIP(); err != nil {
+			fatalf("Load GeoIP database failed: %s", err)
+		}
+	}
+
+	if err := setupMaintenance(); err != nil {
+		fatalf("Bad maintenance allow list: %s", err)
+	}
+	if err := setupAllow(); err != nil {
+		fatalf("Bad target server allow list: %s", err)
+	}
+	if err := setupTLS(); err != nil {
+		fatalf("Setup TLS failed: %s", err)
+	}
+	if cfgBackendAck && (cfgMux || cfgPoolSize > 0) {
+		fatal("Backend ack can't be used with multiplexed or pooled connections")
+	}
+	if cfgAckByte > 0xff {
+		fatalf("Bad backend ack byte %d", cfgAckByte)
+	}
+	if cfgUpSOCKS != "" {
+		if err := checkUpstream(); err != nil {
+			fatalf("Bad upstream SOCKS proxy: %s", err)
+		}
+	}
+
+	// -check stops here, before anything is opened or written
+	if cfgCheckOnly {
+		checkSummary()
+		return
+	}
+
+	if cfgAuditLog != "" {
+		if err := setupAudit(); err != nil {
+			fatalf("Open audit log failed: %s", err)
+		}
+	}
 
 	if cfgPprofAddr != "" {
-		listener, err := net.Listen("tcp", cfgPprofAddr)
+		listener, err := listenPprof(cfgPprofAddr)
 		if err != nil {
 			fatalf("Setup pprof failed: %s", err)
 		}
-		cfgPprofAddr = listener.Addr().String()
+		// closing a Unix listener removes its socket file
+		defer listener.Close()
+		if _, ok := unixPath(cfgPprofAddr); !ok {
+			cfgPprofAddr = listener.Addr().String()
+		}
 		go http.Serve(listener, nil)
 	} else {
 		cfgPprofAddr = "disable"
 	}
 
-	pid := syscall.Getpid()
-	if err := ioutil.WriteFile("gateway.pid", []byte(strconv.Itoa(pid)), 0644); err != nil {
-		fatalf("Can't write pid file: %s", err)
+	if cfgStatsdAddr != "" {
+		if err := setupStatsd(); err != nil {
+			fatalf("Setup statsd failed: %s", err)
+		}
+	}
+
+	if cfgMaxConns > 0 {
+		connSlots = make(chan struct{}, cfgMaxConns)
+	}
+
+	pid := os.Getpid()
+	if cfgPidFile != "" {
+		if err := writePidFile(cfgPidFile, pid); err != nil {
+			fatalf("Can't write pid file: %s", err)
+		}
+		defer os.Remove(cfgPidFile)
+	}
+
+	if cfgWaitTargets != "" {
+		waitBackend()
 	}
-	defer os.Remove("gateway.pid")
 
 	start()
+	setReady()
+	go sampleThroughput()
+	if cfgRateLimit > 0 {
+		go sweepRateBuckets()
+	}
+	if cfgPoolSize > 0 {
+		go sweepPool()
+	}
+	if cfgLogFailures && cfgFailWindow > 0 {
+		go summarizeFailures()
+	}
 
 	printf(`Gateway running
 Address:      %s
 Reuse port:   %v
+Accept loops: %d
 Dial retry:   %d
 Dial timeout: %s
+Dial backoff: %s
 Buffer size:  %d
+Handshake:    %d
+TFO server:   %v
+TFO client:   %v
+TLS:          %v
+Cipher:       %s
 Passphrase:   %s
 Profiling:    %s
 Process ID:   %d`,
 		cfgGatewayAddr,
 		cfgReusePort,
+		len(gatewayListeners),
 		cfgDialRetry,
 		time.Duration(cfgDialTimeout),
+		time.Duration(cfgDialBackoff),
 		cfgBufferSize,
-		cfgSecret,
+		cfgHandshake,
+		cfgTFOServer,
+		cfgTFOClient,
+		gatewayTLS != nil,
+		cfgCipher,
+		currentSecret(),
 		cfgPprofAddr,
 		pid)
 
 	exitChan := make(chan os.Signal, 1)
-	signal.Notify(exitChan, syscall.SIGTERM)
-	signal.Notify(exitChan, syscall.SIGINT)
-	<-exitChan
-	printf("Gateway killed")
+	notifyExit(exitChan)
+	reloadChan := make(chan os.Signal, 1)
+	notifyReload(reloadChan)
+	dumpChan := make(chan os.Signal, 1)
+	notifyDump(dumpChan)
+	var idleChan <-chan struct{}
+	if cfgIdleExit > 0 {
+		idleChan = watchIdle()
+	}
+	for {
+		select {
+		case <-reloadChan:
+			reload()
+		case <-dumpChan:
+			go writeDump()
+		case <-idleChan:
+			printf("Gateway idle for %s, exited", time.Duration(cfgIdleExit))
+			return
+		case <-exitChan:
+			printf("Gateway stopping, %d active connections", atomic.LoadInt64(&activeConns))
+			drain()
+			printf("Gateway killed")
+			return
+		}
+	}
+}
+
+// checkSummary prints what -check validated, the settings which were loaded
+// from files are summarized since they are not on the command line.
+func checkSummary() {
+	names := 0
+	if m, ok := addrMap.Load().(map[string]string); ok {
+		names = len(m)
+	}
+	printf(`Gateway config OK
+Address:      %s
+Cipher:       %s
+Passphrase:   sha256 %s
+TLS:          %v
+Allow CIDRs:  %d
+Allow ports:  %d
+Address map:  %d names
+Tenants:      %d`,
+		cfgGatewayAddr,
+		cfgCipher,
+		secretID(currentSecret()),
+		gatewayTLS != nil,
+		len(allowNets),
+		len(allowPorts),
+		names,
+		len(tenantSecrets))
+}
+
+func reload() {
+	if cfgGeoIPPath != "" {
+		if err := loadGeoIP(); err != nil {
+			printf("Reload GeoIP database failed: %s", err)
+			auditf("SIGHUP", "reload-geoip", nil, err.Error())
+		} else {
+			printf("GeoIP database reloaded")
+			auditf("SIGHUP", "reload-geoip", nil, "ok")
+		}
+	}
+	if cfgSecretFile != "" {
+		if err := loadSecret(); err != nil {
+			printf("Reload passphrase failed, keep the old one: %s", err)
+			auditf("SIGHUP", "reload-secret", nil, err.Error())
+		} else {
+			id := secretID(currentSecret())
+			printf("Passphrase reloaded, sha256 %s", id)
+			auditf("SIGHUP", "reload-secret", map[string]string{"sha256": id}, "ok")
+		}
+	}
+	if cfgAddrMap != "" {
+		if err := loadAddrMap(); err != nil {
+			printf("Reload address map failed, keep the old one: %s", err)
+			auditf("SIGHUP", "reload-addr-map", nil, err.Error())
+		} else {
+			printf("Address map reloaded")
+			auditf("SIGHUP", "reload-addr-map", nil, "ok")
+		}
+	}
 }
 
 func fatal(t string) {
 	if !isTest {
-		log.Fatal(t)
+		logLine("fatal", nil, nil, t)
+		os.Exit(1)
 	}
 	panic(t)
 }
 
 func fatalf(t string, args ...interface{}) {
-	if !isTest {
-		log.Fatalf(t, args...)
-	}
-	panic(fmt.Sprintf(t, args...))
+	fatal(fmt.Sprintf(t, args...))
 }
 
 func printf(t string, args ...interface{}) {
-	if !isTest {
-		log.Printf(t, args...)
-	}
+	logLine("info", nil, nil, fmt.Sprintf(t, args...))
 }
 
 func start() {
-	listener, err := listen()
+	if cfgNetwork != "tcp" && cfgNetwork != "tcp4" && cfgNetwork != "tcp6" {
+		fatalf("Setup listener failed: unknown network %q", cfgNetwork)
+	}
+	n := 1
+	if cfgReusePort && canReusePort {
+		if n = int(cfgAcceptLoops); n == 0 {
+			n = runtime.GOMAXPROCS(0)
+		}
+	}
+	listeners, err := listenAll(cfgGatewayAddr, n)
 	if err != nil {
 		fatalf("Setup listener failed: %s", err)
 	}
-	cfgGatewayAddr = listener.Addr().String()
-	go loop(listener)
+	cfgGatewayAddr = listeners[0].Addr().String()
+	gatewayListeners = listeners
+	for _, listener := range listeners {
+		if cfgTFOServer {
+			if err := setFastOpen(listener); err != nil {
+				printf("TCP Fast Open disabled on listener: %s", err)
+			}
+		}
+		loops.Add(1)
+		go func(listener net.Listener) {
+			defer loops.Done()
+			loop(listener)
+		}(listener)
+	}
+}
+
+// listenAll opens n listeners on addr, more than one needs -reuse so the
+// kernel spreads new connections over them. With port 0 the later listeners
+// take the port the first one got.
+func listenAll(addr string, n int) ([]net.Listener, error) {
+	var listeners []net.Listener
+	for i := 0; i < n; i++ {
+		listener, err := listen(addr)
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, err
+		}
+		addr = listener.Addr().String()
+		listeners = append(listeners, listener)
+		// listen() turned -reuse off, the port takes one listener only
+		if !cfgReusePort {
+			break
+		}
+	}
+	return listeners, nil
+}
+
+// listenPprof opens the HTTP address of -pprof, either TCP or a Unix socket
+// like "unix:/var/run/gateway.sock" which only local users with permission
+// to the file can reach. A socket file left by a crashed gateway is removed
+// first, other files at the path are not.
+func listenPprof(addr string) (net.Listener, error) {
+	path, ok := unixPath(addr)
+	if !ok {
+		return net.Listen("tcp", addr)
+	}
+	if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+	return net.Listen("unix", path)
 }
 
 func loop(listener net.Listener) {
@@ -153,10 +585,47 @@ func loop(listener net.Listener) {
 	for {
 		conn, err := accept(listener)
 		if err != nil {
+			if atomic.LoadInt32(&closing) == 1 {
+				return
+			}
 			fatalf("Gateway accept failed: %s", err)
 			return
 		}
-		go handle(conn)
+		slots := connSlots
+		if slots != nil {
+			select {
+			case slots <- struct{}{}:
+			default:
+				if !cfgFullReject {
+					// -max-conns reached, the rest wait in the kernel backlog
+					select {
+					case slots <- struct{}{}:
+					case <-acceptStop:
+						conn.Close()
+						return
+					}
+					break
+				}
+				connRejects.Add(1)
+				go func() {
+					// a plain close, SO_LINGER of -linger would discard the code
+					rejectRetry(conn, codeUnavailable, "too many connections", cfgRetryFull)
+					conn.Close()
+				}()
+				continue
+			}
+		}
+		// count before spawning, so a connection accepted right before
+		// stopAccept() is never missed
+		atomic.AddInt64(&activeConns, 1)
+		atomic.AddUint64(&totalConns, 1)
+		go func() {
+			defer atomic.AddInt64(&activeConns, -1)
+			if slots != nil {
+				defer func() { <-slots }()
+			}
+			handle(conn)
+		}()
 	}
 }
 
@@ -185,89 +654,718 @@ func accept(listener net.Listener) (net.Conn, error) {
 }
 
 func handle(conn net.Conn) {
+	var s *session
 	defer func() {
-		conn.Close()
 		if err := recover(); err != nil {
 			printf("panic: %v\n\n%s", err, debug.Stack())
+			countPanic()
+			// tell the client it's not a network error, unless it has got
+			// a code and maybe relayed data already. The code is followed
+			// by a plain close, SO_LINGER of -linger would discard it.
+			if s != nil && s.code == nil {
+				s.reject(codeInternal, "internal error")
+				conn.Close()
+				return
+			}
+			forceClose(conn)
+			return
 		}
+		conn.Close()
 	}()
 
-	agent := handshake(conn)
-	if agent == nil {
+	statsdCount("accept", 1)
+	tuneConn(conn)
+	s = newSession(conn)
+	defer s.cancel()
+	if cfgAccessLog {
+		defer s.accessLog()
+	}
+	if !setup(s) {
 		return
 	}
+	conn = s.conn
+	agent := s.agent
 	defer agent.Close()
 
+	s.register()
+	defer s.Close()
+	defer countClose(s)
+
+	// -poll copies on its own and can't enforce the byte limit, the idle and
+	// stall timeouts or compress, the others cancel the session. It waits
+	// for the cancel itself, a tunnel costs no goroutine but this one.
+	poll := cfgPoll && cfgMaxBytes == 0 && cfgIdleTimeout == 0 && cfgWriteStall == 0 && !s.compress && !s.udp
+	stop := make(chan struct{})
+	defer close(stop)
+	if !poll {
+		go s.watch(stop)
+	}
+
+	if cfgMaxLife > 0 {
+		timer := time.AfterFunc(time.Duration(cfgMaxLife), func() {
+			s.closeLimit(closeDurationCap, fmt.Sprintf("max-conn-duration %s", time.Duration(cfgMaxLife)))
+		})
+		defer timer.Stop()
+	}
+
+	var w, aw io.Writer = conn, agent
+	if cfgWriteStall > 0 {
+		w, aw = stallWriter{s, conn}, stallWriter{s, agent}
+	}
+	var cr, ar io.Reader = conn, agent
+	if cfgIdleTimeout > 0 {
+		cr, ar = idleReader{s, conn}, idleReader{s, agent}
+	}
+	var zw *deflateWriter
+	if s.compress {
+		zw = newDeflateWriter(w)
+		w, cr = zw, flate.NewReader(io.MultiReader(bytes.NewReader(s.pending), cr))
+	}
+	if cfgMaxBytes > 0 {
+		w, aw = byteLimit{s, w}, byteLimit{s, aw}
+	}
+	if len(s.early) > 0 {
+		n, err := w.Write(s.early)
+		atomic.AddUint64(&s.download, uint64(n))
+		atomic.AddUint64(&totalDownload, uint64(n))
+		if err != nil {
+			return
+		}
+	}
+	if s.udp {
+		udpRelay(s, cr, ar, w, aw)
+		statsdCount("bytes.download", int64(atomic.LoadUint64(&s.download)))
+		statsdCount("bytes.upload", int64(atomic.LoadUint64(&s.upload)))
+		return
+	}
+	pool := copyPool()
+
+	if poll {
+		if pollRelay(s, pool) {
+			statsdCount("bytes.download", int64(atomic.LoadUint64(&s.download)))
+			statsdCount("bytes.upload", int64(atomic.LoadUint64(&s.upload)))
+			return
+		}
+		go s.watch(stop)
+	}
+
+	// each direction only passes its EOF on to the other side, both sides
+	// are closed by the defers once both directions are done
+	done := make(chan struct{})
 	go func() {
+		defer close(done)
 		defer func() {
-			agent.Close()
-			conn.Close()
 			if err := recover(); err != nil {
+				forceClose(agent)
+				forceClose(conn)
 				printf("panic: %v\n\n%s", err, debug.Stack())
+				countPanic()
 			}
 		}()
-		copy(conn, agent)
+		err := copy(w, ar, &s.download, &totalDownload, pool)
+		if err == nil && zw != nil {
+			err = zw.Close()
+		}
+		statsdCount("bytes.download", int64(atomic.LoadUint64(&s.download)))
+		if err == nil {
+			s.closedBy(closeBackendEOF)
+		} else {
+			s.closedBy(closeError)
+		}
+		if err != nil || !closeWrite(conn) {
+			agent.Close()
+			conn.Close()
+		}
 	}()
-	copy(agent, conn)
+	err := copy(aw, cr, &s.upload, &totalUpload, pool)
+	statsdCount("bytes.upload", int64(atomic.LoadUint64(&s.upload)))
+	if err == nil {
+		s.closedBy(closeClientEOF)
+	} else {
+		s.closedBy(closeError)
+	}
+	if err != nil || !closeWrite(agent) {
+		agent.Close()
+		conn.Close()
+	}
+	<-done
+}
+
+var copyPoolMini int32
+
+// copyPool picks copy buffers for a new connection. Beyond -buffer-limit
+// active connections, smaller buffers are used to bound the total memory.
+func copyPool() *sync.Pool {
+	mini := cfgBufferLimit > 0 && atomic.LoadInt64(&activeConns) > int64(cfgBufferLimit)
+	if mini {
+		if atomic.CompareAndSwapInt32(&copyPoolMini, 0, 1) {
+			printf("Copy buffer size: %d, active connections: %d", miniBufferSize, atomic.LoadInt64(&activeConns))
+		}
+		return &miniCopyBufPool
+	}
+	if atomic.CompareAndSwapInt32(&copyPoolMini, 1, 0) {
+		printf("Copy buffer size: %d, active connections: %d", cfgBufferSize, atomic.LoadInt64(&activeConns))
+	}
+	return &copyBufPool
 }
 
-func handshake(conn net.Conn) (agent net.Conn) {
+// setup takes a new connection to the relay phase. Meanwhile the connection
+// is counted as pending, at most -max-pending of them run at the same time.
+func setup(s *session) bool {
+	conn := s.conn
+
+	n := atomic.AddInt64(&pendingConns, 1)
+	defer atomic.AddInt64(&pendingConns, -1)
+	if cfgMaxPending > 0 && n > int64(cfgMaxPending) {
+		pendingRejects.Add(1)
+		forceClose(conn)
+		return false
+	}
+
+	// covers PROXY protocol header, TLS handshake and the address, cleared
+	// by handshake() once the address is read
+	if cfgAddrTimeout > 0 {
+		conn.SetReadDeadline(time.Now().Add(time.Duration(cfgAddrTimeout)))
+	}
+
+	if cfgProxyProto {
+		client, err := readProxyHeader(conn)
+		if err != nil {
+			s.logf("warn", nil, "Bad PROXY protocol header from %s: %s", conn.RemoteAddr(), err)
+			forceClose(conn)
+			return false
+		}
+		if client != nil {
+			s.client = client
+		}
+	}
+
+	// PROXY protocol header is plain text in front of TLS, the TLS handshake
+	// itself runs on the first read
+	if gatewayTLS != nil {
+		s.conn = tls.Server(conn, gatewayTLS)
+		conn = s.conn
+	}
+
+	if !rateAllow(s.client) {
+		forceClose(conn)
+		return false
+	}
+
+	if !geoipAllow(s.client) {
+		forceClose(conn)
+		return false
+	}
+
+	if !maintenanceAllow(s.client) {
+		s.code = codeUnavailable
+		rejectRetry(conn, codeUnavailable, "maintenance", cfgRetryMaint)
+		return false
+	}
+
+	return handshake(s)
+}
+
+// forceClose closes a connection which the gateway gave up on, rather than
+// one the peer finished with. The -linger setting only applies here, because
+// SO_LINGER with 0 seconds discards unsent data.
+func forceClose(conn net.Conn) {
+	if cfgLinger >= 0 {
+		raw := conn
+		// a -tls-cert connection, the linger goes on the TCP one below
+		if nc, ok := conn.(interface {
+			NetConn() net.Conn
+		}); ok {
+			raw = nc.NetConn()
+		}
+		if tc, ok := raw.(*net.TCPConn); ok {
+			tc.SetLinger(cfgLinger)
+		}
+	}
+	conn.Close()
+}
+
+// closeWrite half-closes a connection, the peer reads EOF but can still send
+// data back. It returns false if the connection doesn't support half-close.
+func closeWrite(conn net.Conn) bool {
+	if hc, ok := conn.(interface {
+		CloseWrite() error
+	}); ok {
+		return hc.CloseWrite() == nil
+	}
+	return false
+}
+
+// tuneConn applies -keepalive and -nodelay to a TCP connection of either side,
+// other connections are left as they are.
+func tuneConn(conn net.Conn) {
+	tc, ok := conn.(*net.TCPConn)
+	if !ok {
+		return
+	}
+	if cfgKeepAlive == 0 {
+		tc.SetKeepAlive(false)
+	} else if cfgKeepAlive > 0 {
+		tc.SetKeepAlive(true)
+		tc.SetKeepAlivePeriod(time.Duration(cfgKeepAlive) * time.Second)
+	}
+	tc.SetNoDelay(cfgNoDelay)
+}
+
+// dialNext picks the first candidate of multiple target server addresses.
+var dialNext uint32
+
+// handshake reads the target server address from the client and connects to
+// it. On success s.agent is set and the client has got codeOK.
+func handshake(s *session) bool {
+	conn := s.conn
+
 	var b = handshakeBufPool.Get().(*[]byte)
 	buf := *b
 	defer handshakeBufPool.Put(b)
 
-	// read and decrypt target server address
+	// read and decrypt target server address, after the version byte if any
 	var err error
 	var addr, remain []byte
+	skip := 0
 	for n, nn := 0, 0; n < len(buf); n += nn {
+		if cfgMinRate > 0 {
+			minRateDeadline(s, n)
+		}
 		nn, err = conn.Read(buf[n:])
-		if err != nil {
-			conn.Write(codeBadReq)
-			return
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			s.reject(codeBadReq, "handshake timeout")
+			return false
+		} else if err != nil {
+			s.reject(codeBadReq, "bad request")
+			return false
+		}
+		if n == 0 && nn > 0 && buf[0] == socksVersion && cfgSOCKS {
+			if addr, remain, err = socksHandshake(s, buf[:nn]); err != nil {
+				s.socksFail(err)
+				return false
+			}
+			s.socks = true
+			break
+		}
+		if n == 0 && nn > 0 && buf[0]&versionFlag != 0 {
+			version := buf[0] &^ (versionFlag | compressFlag | timingFlag)
+			if version == 0 || version > maxVersion {
+				s.reject(codeBadReq, "unsupported version")
+				return false
+			}
+			s.version, skip = version, 1
+			s.compress = buf[0]&compressFlag != 0 && cfgCompress
+			s.timing = buf[0]&timingFlag != 0
 		}
+		// the line is at most -handshake bytes, no larger input is decrypted
 		if i := bytes.IndexByte(buf[n:n+nn], '\n'); i >= 0 {
-			if addr, err = aes256cbc.DecryptBase64(cfgSecret, buf[:n+i]); err != nil {
-				conn.Write(codeBadAddr)
-				return nil
+			decryptStart := time.Now()
+			addr, s.tenant, err = decryptLine(buf[skip : n+i])
+			observeDecrypt(time.Since(decryptStart))
+			if err == errUnknownTenant {
+				s.logf("warn", codeBadAddr, "Unknown tenant %q from client %s", s.tenant, s.client)
+				s.reject(codeBadAddr, "unknown tenant")
+				return false
+			} else if err != nil {
+				s.reject(codeBadAddr, "decrypt failed")
+				return false
 			}
 			remain = buf[n+i+1 : n+nn]
 			break
 		}
 	}
 	if addr == nil {
-		conn.Write(codeBadReq)
-		return nil
+		s.reject(codeBadReq, "address too long")
+		return false
+	}
+	if cfgAddrTimeout > 0 || cfgMinRate > 0 {
+		conn.SetReadDeadline(time.Time{})
+	}
+	if bytes.HasPrefix(addr, udpScheme) {
+		if !cfgUDP {
+			s.reject(codeBadAddr, "udp disabled")
+			return false
+		}
+		s.udp, addr = true, addr[len(udpScheme):]
+		s.compress = false
 	}
 
-	// dial to target server
-	for i := uint(0); i < cfgDialRetry; i++ {
-		agent, err = net.DialTimeout("tcp", string(addr), time.Duration(cfgDialTimeout))
-		if err == nil {
-			break
+	// stages below share the -setup-budget, each one only gets what is left
+	ctx, cancel := s.ctx, context.CancelFunc(func() {})
+	if cfgSetupBudget > 0 {
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(cfgSetupBudget))
+	}
+	defer cancel()
+
+	// dial to target server, the address may be a comma separated list of
+	// candidates, they are tried in turn starting from a round-robin one
+	candidates := strings.Split(string(addr), ",")
+	for i := range candidates {
+		candidates[i] = strings.TrimSpace(candidates[i])
+	}
+	if candidates, err = mapTargets(candidates); err != nil {
+		s.logf("warn", codeBadAddr, "Unknown target server name %s for client %s", addr, s.client)
+		s.reject(codeBadAddr, "unknown name")
+		return false
+	}
+	if candidates, err = allowTargets(ctx, candidates); err != nil {
+		if err == errForbidden {
+			s.logf("warn", codeForbidden, "Forbidden target server %s for client %s", addr, s.client)
+			s.reject(codeForbidden, "forbidden target")
+		} else {
+			s.reject(codeDialErr, dialReason(err))
 		}
-		if ne, ok := err.(net.Error); ok && ne.Timeout() {
-			continue
+		return false
+	}
+	if cfgBlockSelf && !s.udp {
+		if candidates, err = checkSelf(ctx, candidates); err != nil {
+			if err == errSelfTarget {
+				s.logf("warn", codeSelfLoop, "Target server %s is the gateway itself, client %s", addr, s.client)
+				s.reject(codeSelfLoop, "gateway itself")
+			} else {
+				s.reject(codeDialErr, dialReason(err))
+			}
+			return false
 		}
-		conn.Write(codeDialErr)
-		return nil
 	}
-	if err != nil {
-		conn.Write(codeDialTimeout)
-		return nil
+	first := 0
+	if len(candidates) > 1 {
+		first = int(atomic.AddUint32(&dialNext, 1) % uint32(len(candidates)))
+	}
+	var agent net.Conn
+	dialBegin := time.Now()
+	for i := uint(0); i < cfgDialRetry && agent == nil && ctx.Err() == nil; i++ {
+		if i > 0 && cfgDialBackoff > 0 {
+			select {
+			case <-time.After(backoff(i - 1)):
+			case <-ctx.Done():
+				continue
+			}
+		}
+		timeout := false
+		for j := range candidates {
+			target := candidates[(first+j)%len(candidates)]
+			s.target = target
+			dialStart := time.Now()
+			if s.udp {
+				agent, err = dialUDP(ctx, target)
+			} else if cfgMux {
+				agent, err = dialMux(ctx, target)
+			} else if cfgPoolSize > 0 {
+				agent, err = dialPooled(ctx, target)
+			} else {
+				agent, err = dial(ctx, target)
+			}
+			dialTime := time.Since(dialStart)
+			statsdTiming("dial", dialTime)
+			observeDial(dialTime)
+			s.dialTime = time.Since(dialBegin)
+			if err == nil {
+				break
+			}
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				timeout = true
+			}
+		}
+		// every candidate refused, retry only helps for timeouts
+		if agent == nil && !timeout {
+			s.logf("warn", codeDialErr, "Dial target server %s failed: %s", s.target, err)
+			s.reject(codeDialErr, dialReason(err))
+			return false
+		}
+	}
+	if agent == nil {
+		s.logf("warn", codeDialTimeout, "Dial target server %s timeout", s.target)
+		s.reject(codeDialTimeout, "dial timeout")
+		return false
+	}
+
+	// tell target server who the client is, before any data of the client
+	if cfgAgentProxy && !s.udp {
+		if _, err := agentWrite(agent, proxyHeaderV1(s.client, conn.LocalAddr())); err != nil {
+			forceClose(agent)
+			s.reject(codeDialErr, "target closed")
+			return false
+		}
+	}
+
+	// make sure target server speaks the protocol of the gateway
+	if cfgBackendAck && !s.udp {
+		deadline := time.Now().Add(time.Duration(cfgAckTimeout))
+		if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+			deadline = d
+		}
+		if err := backendAck(agent, deadline); err != nil {
+			forceClose(agent)
+			s.logf("warn", codeDialErr, "No ack from target server %s: %s", s.target, err)
+			s.reject(codeDialErr, "no backend ack")
+			return false
+		}
+	}
+
+	// make sure target server didn't close the connection right after accept
+	var early []byte
+	if cfgDialProbe > 0 && !s.udp {
+		early = make([]byte, miniBufferSize)
+		deadline := time.Now().Add(time.Duration(cfgDialProbe))
+		if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+			deadline = d
+		}
+		n, err := probe(agent, early, deadline)
+		if err != nil {
+			forceClose(agent)
+			s.reject(codeDialErr, "target closed")
+			return false
+		}
+		early = early[:n]
+	}
+
+	// send remainder data in buffer before the code, a client whose data
+	// didn't reach target server whole gets a failure instead of 200
+	sent := false
+	if len(remain) > 0 && (s.udp || s.compress) {
+		// frames are cut by udpRelay() or data is inflated by the relay,
+		// the buffer goes back to the pool
+		s.pending = append([]byte(nil), remain...)
+	} else if len(remain) > 0 {
+		n, err := agentWrite(agent, remain)
+		if err == nil && n < len(remain) {
+			err = io.ErrShortWrite
+		}
+		s.upload += uint64(n)
+		atomic.AddUint64(&totalUpload, uint64(n))
+		if err != nil {
+			forceClose(agent)
+			s.logf("warn", codeDialErr, "Forward %d bytes to target server %s failed: %s", len(remain), s.target, err)
+			s.reject(codeDialErr, "target closed")
+			return false
+		}
+		sent = true
 	}
 
 	// send succeed code
-	if _, err = conn.Write(codeOK); err != nil {
-		agent.Close()
-		return nil
+	if s.socks {
+		err = socksReply(conn, socksSucceeded)
+	} else if s.version > 0 {
+		reply := versionedReply(s.version, codeOK, "")
+		if s.compress {
+			reply[0] |= compressFlag
+		}
+		if s.timing {
+			reply[0] |= timingFlag
+			reply = append(reply, timingHeader(s.dialTime)...)
+		}
+		err = writeCode(conn, reply)
+	} else {
+		err = writeCode(conn, codeOK)
 	}
+	if err != nil {
+		// nothing was sent to a pooled connection, another client can use it
+		if cfgPoolSize > 0 && !cfgMux && !s.udp && !cfgAgentProxy && len(early) == 0 && !sent {
+			poolPut(s.target, agent)
+		} else {
+			forceClose(agent)
+		}
+		return false
+	}
+	s.code = codeOK
 
-	// send remainder data in buffer
-	if len(remain) > 0 {
-		if _, err = agent.Write(remain); err != nil {
-			agent.Close()
-			return nil
+	// send data which target server sent during probe, compressed it goes
+	// at the start of the deflate stream
+	if len(early) > 0 && s.compress {
+		s.early = early
+	} else if len(early) > 0 {
+		n, err := conn.Write(early)
+		s.download += uint64(n)
+		atomic.AddUint64(&totalDownload, uint64(n))
+		if err != nil {
+			forceClose(agent)
+			return false
+		}
+	}
+
+	s.agent = agent
+	return true
+}
+
+// writeCode writes a response of the handshake to the client, a status code
+// or a SOCKS reply, within -code-write-timeout. A client which doesn't read
+// can't hold the handler on an error path. The deadline is cleared before
+// returning, the relay has its own.
+func writeCode(conn net.Conn, msg []byte) error {
+	if cfgCodeWrite > 0 {
+		conn.SetWriteDeadline(time.Now().Add(time.Duration(cfgCodeWrite)))
+		defer conn.SetWriteDeadline(time.Time{})
+	}
+	_, err := conn.Write(msg)
+	return err
+}
+
+// minRateDeadline sets the read deadline by which a client which has sent n
+// bytes of the handshake must send one more to keep -handshake-min-rate. A
+// client dribbling a byte every few seconds gets a timeout instead of holding
+// the connection until -handshake-timeout, or forever without one.
+func minRateDeadline(s *session, n int) {
+	deadline := s.start.Add(time.Second + time.Duration(n+1)*time.Second/time.Duration(cfgMinRate))
+	if cfgAddrTimeout > 0 {
+		if d := s.start.Add(time.Duration(cfgAddrTimeout)); d.Before(deadline) {
+			deadline = d
 		}
 	}
-	return
+	s.conn.SetReadDeadline(deadline)
+}
+
+// agentWrite writes data of the handshake to the target server within
+// -backend-write-timeout, which is separate from the -timeout of dial. The
+// deadline is cleared before returning, the relay has its own.
+func agentWrite(agent net.Conn, b []byte) (int, error) {
+	if cfgAgentWrite > 0 {
+		agent.SetWriteDeadline(time.Now().Add(time.Duration(cfgAgentWrite)))
+		defer agent.SetWriteDeadline(time.Time{})
+	}
+	return agent.Write(b)
+}
+
+// probe waits a short time for the target server to close the connection.
+// Data sent by target server in the meantime is kept in buf.
+func probe(agent net.Conn, buf []byte, deadline time.Time) (int, error) {
+	agent.SetReadDeadline(deadline)
+	n, err := agent.Read(buf)
+	agent.SetReadDeadline(time.Time{})
+	if n > 0 {
+		return n, nil
+	}
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return 0, nil
+	}
+	return 0, err
+}
+
+// reject sends an error code to the client, the reason is only sent with
+// -verbose-codes.
+func reject(conn net.Conn, code []byte, reason string) {
+	rejectRetry(conn, code, reason, 0)
+}
+
+// reject sends an error code to the client of the session, the code is kept
+// for the access log.
+func (s *session) reject(code []byte, reason string) {
+	s.code = code
+	if bytes.Equal(code, codeBadReq) || bytes.Equal(code, codeBadAddr) {
+		logFailure(s, reason)
+	}
+	if s.socks {
+		socksReply(s.conn, socksCode(code))
+		countReject(code)
+		return
+	}
+	if s.version > 0 {
+		writeCode(s.conn, versionedReply(s.version, code, reason))
+		countReject(code)
+		return
+	}
+	reject(s.conn, code, reason)
+}
+
+// rejectRetry sends an overload code with a hint of how many seconds the
+// client should wait before reconnect, like "503 retry-after=30\n". Clients
+// only read the code are not affected, the connection is closed after that.
+// With -verbose-codes the reason goes in between, like "503 maintenance\n".
+func rejectRetry(conn net.Conn, code []byte, reason string, retry uint) {
+	writeCode(conn, rejectMsg(code, reason, retry))
+	countReject(code)
+}
+
+func rejectMsg(code []byte, reason string, retry uint) []byte {
+	if retry == 0 && !cfgVerboseCode {
+		return code
+	}
+	msg := make([]byte, 0, 64)
+	msg = append(msg, code...)
+	if cfgVerboseCode {
+		msg = append(msg, ' ')
+		msg = append(msg, reason...)
+	}
+	if retry > 0 {
+		msg = append(msg, " retry-after="...)
+		msg = strconv.AppendUint(msg, uint64(retry), 10)
+	}
+	return append(msg, '\n')
+}
+
+func countReject(code []byte) {
+	statsdCount("handshake."+string(code), 1)
+	countHandshakeFailure(code)
+}
+
+// dialReason describes a dial error for -verbose-codes. The error text itself
+// is not sent because it carries the target server address.
+func dialReason(err error) string {
+	switch err {
+	case upstreamError(socksRefused):
+		return "connection refused"
+	case upstreamError(socksUnreachable):
+		return "host unreachable"
+	case upstreamError(socksNetUnreach):
+		return "network unreachable"
+	}
+	if _, ok := err.(*net.DNSError); ok {
+		return "no such host"
+	}
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return "dial timeout"
+	}
+	if oe, ok := err.(*net.OpError); ok {
+		if _, ok := oe.Err.(*net.DNSError); ok {
+			return "no such host"
+		}
+		if se, ok := oe.Err.(*os.SyscallError); ok {
+			switch se.Err {
+			case syscall.ECONNREFUSED:
+				return "connection refused"
+			case syscall.ENETUNREACH:
+				return "network unreachable"
+			case syscall.EHOSTUNREACH:
+				return "host unreachable"
+			}
+		}
+	}
+	return "dial failed"
+}
+
+// backoff returns how long to wait before the n+1th retry. The wait doubles
+// each time with 20% jitter, so connections timed out together don't retry
+// together, and never exceeds the dial timeout to keep the retries bounded.
+func backoff(n uint) time.Duration {
+	d := time.Duration(cfgDialBackoff)
+	for ; n > 0 && d < time.Duration(cfgDialTimeout); n-- {
+		d *= 2
+	}
+	d = d * time.Duration(80+rand.Intn(41)) / 100
+	if d > time.Duration(cfgDialTimeout) {
+		d = time.Duration(cfgDialTimeout)
+	}
+	return d
+}
+
+func dial(ctx context.Context, addr string) (net.Conn, error) {
+	dialer := net.Dialer{Timeout: time.Duration(cfgDialTimeout)}
+	if path, ok := unixPath(addr); ok {
+		return dialer.DialContext(ctx, "unix", path)
+	}
+	if cfgTFOClient {
+		dialer.Control = fastOpenConnect
+	}
+	var conn net.Conn
+	var err error
+	if cfgUpSOCKS != "" {
+		conn, err = dialUpstream(ctx, &dialer, addr)
+	} else {
+		conn, err = dialer.DialContext(ctx, "tcp", addr)
+	}
+	if err == nil {
+		tuneConn(conn)
+	}
+	return conn, err
 }
@@ -1,11 +1,29 @@
 package main
 
 import (
+	"bytes"
+	"compress/flate"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"expvar"
+	"flag"
 	"io"
+	"io/ioutil"
 	"math/rand"
 	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"runtime"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -46,6 +64,19 @@ func Test_Fatals(t *testing.T) {
 	}()
 	cfgSecret = oldSecret
 
+	// handshake too short for any address
+	oldSize := cfgHandshake
+	cfgHandshake = 0
+	func() {
+		defer func() {
+			err := recover()
+			utest.NotNilNow(t, err)
+			utest.Assert(t, strings.Contains(err.(string), "shorter than any encrypted address"))
+		}()
+		main()
+	}()
+	cfgHandshake = oldSize
+
 	// bad pprof address
 	cfgPprofAddr = "xxoo"
 	func() {
@@ -83,6 +114,51 @@ func Test_Fatals(t *testing.T) {
 		}()
 		start()
 	}()
+
+	// address doesn't belong to the network
+	defer func() {
+		cfgNetwork = "tcp"
+	}()
+	for _, network := range []string{"tcp4", "udp"} {
+		cfgGatewayAddr, cfgNetwork = "[::1]:0", network
+		func() {
+			defer func() {
+				err := recover()
+				utest.NotNilNow(t, err)
+				utest.Assert(t, strings.Contains(err.(string), "Setup listener failed"))
+			}()
+			start()
+		}()
+	}
+}
+
+func Test_ListenAll(t *testing.T) {
+	cfgReusePort = true
+	defer func() {
+		cfgReusePort = false
+	}()
+
+	listeners, err := listenAll("127.0.0.1:0", 3)
+	utest.IsNilNow(t, err)
+	utest.EqualNow(t, len(listeners), 3)
+	for _, listener := range listeners {
+		utest.EqualNow(t, listener.Addr().String(), listeners[0].Addr().String())
+		listener.Close()
+	}
+
+	// without -reuse the port can't be shared
+	cfgReusePort = false
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	utest.IsNilNow(t, err)
+	defer listener.Close()
+	_, err = listenAll(listener.Addr().String(), 2)
+	utest.NotNilNow(t, err)
+
+	// -reuse turned off by listen() leaves one listener
+	listeners, err = listenAll("127.0.0.1:0", 3)
+	utest.IsNilNow(t, err)
+	utest.EqualNow(t, len(listeners), 1)
+	listeners[0].Close()
 }
 
 func Test_BadReq1(t *testing.T) {
@@ -190,6 +266,80 @@ func Test_DialTimeout(t *testing.T) {
 	utest.EqualNow(t, string(code), string(codeDialTimeout))
 }
 
+func Test_Backoff(t *testing.T) {
+	oldBackoff, oldTimeout := cfgDialBackoff, cfgDialTimeout
+	cfgDialBackoff, cfgDialTimeout = uint(100*time.Millisecond), uint(time.Second)
+	defer func() {
+		cfgDialBackoff, cfgDialTimeout = oldBackoff, oldTimeout
+	}()
+
+	for i := 0; i < 100; i++ {
+		d := backoff(0)
+		utest.Assert(t, d >= 80*time.Millisecond && d <= 120*time.Millisecond)
+		d = backoff(2)
+		utest.Assert(t, d >= 320*time.Millisecond && d <= 480*time.Millisecond)
+		utest.Assert(t, backoff(10) <= time.Second)
+		utest.Assert(t, backoff(100) <= time.Second)
+	}
+}
+
+func Test_VerboseCodes(t *testing.T) {
+	cfgVerboseCode = true
+	defer func() {
+		cfgVerboseCode = false
+	}()
+
+	response := func(line string) string {
+		conn, err := net.Dial("tcp", cfgGatewayAddr)
+		utest.IsNilNow(t, err)
+		defer conn.Close()
+		_, err = conn.Write([]byte(line + "\n"))
+		utest.IsNilNow(t, err)
+		b, err := ioutil.ReadAll(conn)
+		utest.IsNilNow(t, err)
+		return string(b)
+	}
+
+	utest.EqualNow(t, response("abc"), "401 decrypt failed\n")
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	utest.IsNilNow(t, err)
+	addr := listener.Addr().String()
+	listener.Close()
+	encryptedAddr, err := aes256cbc.EncryptString(string(cfgSecret), addr)
+	utest.IsNilNow(t, err)
+	utest.EqualNow(t, response(encryptedAddr), "502 connection refused\n")
+
+	utest.EqualNow(t, dialReason(&net.DNSError{Err: "no such host", Name: "backend.internal"}), "no such host")
+	utest.EqualNow(t, dialReason(io.EOF), "dial failed")
+}
+
+func Test_HandshakeTimeout(t *testing.T) {
+	oldTimeout := cfgAddrTimeout
+	cfgAddrTimeout = uint(200 * time.Millisecond)
+	defer func() {
+		cfgAddrTimeout = oldTimeout
+	}()
+
+	// client never sends the handshake
+	conn, err := net.Dial("tcp", cfgGatewayAddr)
+	utest.IsNilNow(t, err)
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	code := make([]byte, 3)
+	_, err = io.ReadFull(conn, code)
+	utest.IsNilNow(t, err)
+	utest.EqualNow(t, string(code), string(codeBadReq))
+
+	// the deadline doesn't last into the relay phase
+	listener := testEchoServer(t)
+	defer listener.Close()
+	conn2 := testTunnel(t, listener.Addr().String())
+	defer conn2.Close()
+	time.Sleep(300 * time.Millisecond)
+	testEcho(t, conn2, 1)
+}
+
 func Test_OK(t *testing.T) {
 	listener, err := net.Listen("tcp", "0.0.0.0:0")
 	utest.IsNilNow(t, err)
@@ -375,3 +525,2619 @@ func Benchmark_BufPool2(b *testing.B) {
 	}
 	_ = buf
 }
+
+// a rejected handshake with a large -handshake, the buffer comes from
+// handshakeBufPool and is not allocated per connection
+func Benchmark_HandshakeBuf(b *testing.B) {
+	oldSize := cfgHandshake
+	cfgHandshake = 64 * 1024
+	handshakeBufPool = sync.Pool{New: handshakeBufPool.New}
+	defer func() {
+		cfgHandshake = oldSize
+		handshakeBufPool = sync.Pool{New: handshakeBufPool.New}
+	}()
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		client, server := net.Pipe()
+		go func() {
+			client.Write([]byte("bad\n"))
+			io.ReadFull(client, make([]byte, len(codeBadAddr)))
+			client.Close()
+		}()
+		s := newSession(server)
+		handshake(s)
+		s.cancel()
+		server.Close()
+	}
+}
+
+// testTCPSource returns the accepted side of a loopback TCP connection,
+// reading it gives n bytes then EOF, the way a relay reads a client
+func testTCPSource(tb testing.TB, listener net.Listener, n int) net.Conn {
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	utest.IsNilNow(tb, err)
+	src, err := listener.Accept()
+	utest.IsNilNow(tb, err)
+	_, err = conn.Write(make([]byte, n))
+	utest.IsNilNow(tb, err)
+	conn.Close()
+	return src
+}
+
+// one direction of a connection, with and without the copy buffer pool
+func Benchmark_CopyAlloc(b *testing.B) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	utest.IsNilNow(b, err)
+	defer listener.Close()
+	var n, total uint64
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		src := testTCPSource(b, listener, 4096)
+		b.StartTimer()
+		io.Copy(countWriter{ioutil.Discard, &n, &total}, src)
+		src.Close()
+	}
+}
+
+func Benchmark_CopyPool(b *testing.B) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	utest.IsNilNow(b, err)
+	defer listener.Close()
+	var n, total uint64
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		src := testTCPSource(b, listener, 4096)
+		b.StartTimer()
+		copy(ioutil.Discard, src, &n, &total, &copyBufPool)
+		src.Close()
+	}
+}
+
+// the relay of a TCP connection copies through the pooled buffers, of either
+// size, instead of allocating one per direction
+func Test_CopyBufferPooled(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	utest.IsNilNow(t, err)
+	defer listener.Close()
+
+	for _, pool := range []*sync.Pool{&copyBufPool, &miniCopyBufPool} {
+		// fill the pool first, the sources are opened before measuring
+		var n, total uint64
+		copy(ioutil.Discard, testTCPSource(t, listener, 1), &n, &total, pool)
+		sources := make([]net.Conn, 20)
+		for i := range sources {
+			sources[i] = testTCPSource(t, listener, 4096)
+		}
+
+		var before, after runtime.MemStats
+		runtime.ReadMemStats(&before)
+		for _, src := range sources {
+			copy(ioutil.Discard, src, &n, &total, pool)
+		}
+		runtime.ReadMemStats(&after)
+		for _, src := range sources {
+			src.Close()
+		}
+
+		// a buffer per relay would be 32KB each
+		perRelay := (after.TotalAlloc - before.TotalAlloc) / uint64(len(sources))
+		utest.Assert(t, perRelay < 4096)
+	}
+}
+
+// a relay between TCP connections is spliced on Linux, the
+// counters still see every byte
+func Test_CopyTCP(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	utest.IsNilNow(t, err)
+	defer listener.Close()
+
+	data := RandBytes(1024 * 1024)
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	utest.IsNilNow(t, err)
+	src, err := listener.Accept()
+	utest.IsNilNow(t, err)
+	defer src.Close()
+	go func() {
+		conn.Write(data)
+		conn.Close()
+	}()
+
+	dst, err := net.Dial("tcp", listener.Addr().String())
+	utest.IsNilNow(t, err)
+	peer, err := listener.Accept()
+	utest.IsNilNow(t, err)
+	defer peer.Close()
+
+	var n, total uint64
+	go func() {
+		copy(dst, src, &n, &total, &miniCopyBufPool)
+		dst.Close()
+	}()
+	b, err := ioutil.ReadAll(peer)
+	utest.IsNilNow(t, err)
+	utest.Assert(t, bytes.Equal(b, data))
+	utest.EqualNow(t, atomic.LoadUint64(&n), uint64(len(data)))
+}
+
+func Test_Maintenance(t *testing.T) {
+	setMaintenance(true)
+	defer setMaintenance(false)
+
+	conn, err := net.Dial("tcp", cfgGatewayAddr)
+	utest.IsNilNow(t, err)
+	defer conn.Close()
+
+	code := make([]byte, 3)
+	_, err = io.ReadFull(conn, code)
+	utest.IsNilNow(t, err)
+	utest.EqualNow(t, string(code), string(codeUnavailable))
+
+	// allowed clients bypass maintenance mode
+	oldNets := maintenanceNets
+	defer func() {
+		maintenanceNets = oldNets
+	}()
+	maintenanceNets, err = parseCIDRs("127.0.0.0/8, ::1")
+	utest.IsNilNow(t, err)
+
+	conn2, err := net.Dial("tcp", cfgGatewayAddr)
+	utest.IsNilNow(t, err)
+	defer conn2.Close()
+
+	_, err = conn2.Write([]byte("abc\n"))
+	utest.IsNilNow(t, err)
+	_, err = io.ReadFull(conn2, code)
+	utest.IsNilNow(t, err)
+	utest.EqualNow(t, string(code), string(codeBadAddr))
+
+	// switching needs a trusted admin address, like closing a connection
+	status := func(on string) int {
+		w := httptest.NewRecorder()
+		maintenanceHandler(w, httptest.NewRequest("POST", "/maintenance?on="+on, nil))
+		return w.Code
+	}
+	oldPprof := cfgPprofAddr
+	defer func() {
+		cfgPprofAddr = oldPprof
+	}()
+	cfgPprofAddr = "0.0.0.0:6060"
+	utest.EqualNow(t, status("false"), http.StatusForbidden)
+	utest.Assert(t, inMaintenance())
+
+	cfgPprofAddr = "127.0.0.1:6060"
+	utest.EqualNow(t, status("abc"), http.StatusBadRequest)
+	utest.EqualNow(t, status("false"), http.StatusOK)
+	utest.Assert(t, !inMaintenance())
+}
+
+func Test_Audit(t *testing.T) {
+	file, err := ioutil.TempFile("", "gateway-audit")
+	utest.IsNilNow(t, err)
+	defer os.Remove(file.Name())
+	file.Close()
+
+	cfgAuditLog = file.Name()
+	utest.IsNilNow(t, setupAudit())
+	defer func() {
+		audit.file.Close()
+		cfgAuditLog, audit.file = "", nil
+	}()
+
+	oldPprof := cfgPprofAddr
+	defer func() {
+		cfgPprofAddr = oldPprof
+		setMaintenance(false)
+	}()
+	cfgPprofAddr = "127.0.0.1:6060"
+	w := httptest.NewRecorder()
+	maintenanceHandler(w, httptest.NewRequest("POST", "/maintenance?on=true", nil))
+	utest.EqualNow(t, w.Code, http.StatusOK)
+	auditf("SIGTERM", "drain", map[string]string{"active": "0"}, "ok")
+
+	data, err := ioutil.ReadFile(file.Name())
+	utest.IsNilNow(t, err)
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	utest.EqualNow(t, len(lines), 2)
+
+	var entry auditEntry
+	utest.IsNilNow(t, json.Unmarshal([]byte(lines[0]), &entry))
+	utest.EqualNow(t, entry.Source, "192.0.2.1:1234")
+	utest.EqualNow(t, entry.Action, "maintenance")
+	utest.EqualNow(t, entry.Params["on"], "true")
+	utest.EqualNow(t, entry.Result, "ok")
+	_, err = time.Parse(time.RFC3339Nano, entry.Time)
+	utest.IsNilNow(t, err)
+
+	entry = auditEntry{}
+	utest.IsNilNow(t, json.Unmarshal([]byte(lines[1]), &entry))
+	utest.EqualNow(t, entry.Source, "SIGTERM")
+	utest.EqualNow(t, entry.Action, "drain")
+}
+
+func Test_Connections(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	utest.IsNilNow(t, err)
+	defer listener.Close()
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.Copy(conn, conn)
+	}()
+
+	conn, err := net.Dial("tcp", cfgGatewayAddr)
+	utest.IsNilNow(t, err)
+	defer conn.Close()
+
+	encryptedAddr, err := aes256cbc.EncryptString(string(cfgSecret), listener.Addr().String())
+	utest.IsNilNow(t, err)
+	_, err = conn.Write([]byte(encryptedAddr + "\nabc"))
+	utest.IsNilNow(t, err)
+
+	code := make([]byte, 6)
+	_, err = io.ReadFull(conn, code)
+	utest.IsNilNow(t, err)
+	utest.EqualNow(t, string(code), string(codeOK)+"abc")
+
+	// the download counter is updated right after the write returned
+	time.Sleep(100 * time.Millisecond)
+
+	w := httptest.NewRecorder()
+	connectionsHandler(w, httptest.NewRequest("GET", "/connections", nil))
+
+	var list []sessionInfo
+	utest.IsNilNow(t, json.Unmarshal(w.Body.Bytes(), &list))
+	var found bool
+	for _, info := range list {
+		if info.Target == listener.Addr().String() {
+			found = true
+			utest.EqualNow(t, info.Upload, uint64(3))
+			utest.EqualNow(t, info.Download, uint64(3))
+		}
+	}
+	utest.Assert(t, found)
+}
+
+func Test_CloseConnection(t *testing.T) {
+	listener := testEchoServer(t)
+	defer listener.Close()
+	conn := testTunnel(t, listener.Addr().String())
+	defer conn.Close()
+	testEcho(t, conn, 1)
+
+	w := httptest.NewRecorder()
+	connectionsHandler(w, httptest.NewRequest("GET", "/connections", nil))
+	var list []sessionInfo
+	utest.IsNilNow(t, json.Unmarshal(w.Body.Bytes(), &list))
+	var id uint64
+	for _, info := range list {
+		if info.Target == listener.Addr().String() {
+			id = info.ID
+		}
+	}
+	utest.Assert(t, id > 0)
+	path := "/connections/" + strconv.FormatUint(id, 10) + "/close"
+
+	status := func(method, path string) int {
+		w := httptest.NewRecorder()
+		closeConnHandler(w, httptest.NewRequest(method, path, nil))
+		return w.Code
+	}
+
+	oldPprof := cfgPprofAddr
+	defer func() {
+		cfgPprofAddr = oldPprof
+	}()
+	cfgPprofAddr = "0.0.0.0:6060"
+	utest.EqualNow(t, status("POST", path), http.StatusForbidden)
+
+	cfgPprofAddr = "127.0.0.1:6060"
+	utest.EqualNow(t, status("GET", path), http.StatusMethodNotAllowed)
+	utest.EqualNow(t, status("POST", "/connections/abc/close"), http.StatusNotFound)
+	utest.EqualNow(t, status("POST", "/connections/0/close"), http.StatusNotFound)
+	testEcho(t, conn, 1)
+
+	utest.EqualNow(t, status("POST", path), http.StatusOK)
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, err := ioutil.ReadAll(conn)
+	utest.IsNilNow(t, err)
+
+	cfgPprofAddr = "unix:/var/run/gateway.sock"
+	utest.Assert(t, adminTrusted())
+	cfgPprofAddr = "8.8.8.8:6060"
+	utest.Assert(t, !adminTrusted())
+}
+
+func Test_Probe(t *testing.T) {
+	oldProbe := cfgDialProbe
+	cfgDialProbe = uint(100 * time.Millisecond)
+	defer func() {
+		cfgDialProbe = oldProbe
+	}()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	utest.IsNilNow(t, err)
+	defer listener.Close()
+
+	encryptedAddr, err := aes256cbc.EncryptString(string(cfgSecret), listener.Addr().String())
+	utest.IsNilNow(t, err)
+
+	// target server closes the connection right after accept
+	go func() {
+		conn, err := listener.Accept()
+		if err == nil {
+			conn.Close()
+		}
+	}()
+
+	conn, err := net.Dial("tcp", cfgGatewayAddr)
+	utest.IsNilNow(t, err)
+	defer conn.Close()
+
+	_, err = conn.Write([]byte(encryptedAddr + "\n"))
+	utest.IsNilNow(t, err)
+	code := make([]byte, 3)
+	_, err = io.ReadFull(conn, code)
+	utest.IsNilNow(t, err)
+	utest.EqualNow(t, string(code), string(codeDialErr))
+
+	// data sent by target server during probe is not lost
+	go func() {
+		conn, err := listener.Accept()
+		if err == nil {
+			defer conn.Close()
+			conn.Write([]byte("hello"))
+			io.Copy(conn, conn)
+		}
+	}()
+
+	conn2, err := net.Dial("tcp", cfgGatewayAddr)
+	utest.IsNilNow(t, err)
+	defer conn2.Close()
+
+	_, err = conn2.Write([]byte(encryptedAddr + "\n"))
+	utest.IsNilNow(t, err)
+	reply := make([]byte, 8)
+	_, err = io.ReadFull(conn2, reply)
+	utest.IsNilNow(t, err)
+	utest.EqualNow(t, string(reply), string(codeOK)+"hello")
+}
+
+func Test_PipelinedData(t *testing.T) {
+	oldSize := cfgHandshake
+	cfgHandshake = 8192
+	handshakeBufPool = sync.Pool{New: handshakeBufPool.New}
+	defer func() {
+		cfgHandshake = oldSize
+		handshakeBufPool = sync.Pool{New: handshakeBufPool.New}
+	}()
+
+	listener := testEchoServer(t)
+	defer listener.Close()
+
+	conn, err := net.Dial("tcp", cfgGatewayAddr)
+	utest.IsNilNow(t, err)
+	defer conn.Close()
+
+	// data sent along with the address is read into the handshake buffer,
+	// all of it reaches target server in order before the relay starts
+	encryptedAddr, err := aes256cbc.EncryptString(string(cfgSecret), listener.Addr().String())
+	utest.IsNilNow(t, err)
+	data := make([]byte, 6000)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	_, err = conn.Write(append([]byte(encryptedAddr+"\n"), data...))
+	utest.IsNilNow(t, err)
+	more := RandBytes(256)
+	_, err = conn.Write(more)
+	utest.IsNilNow(t, err)
+
+	reply := make([]byte, len(codeOK)+len(data)+len(more))
+	_, err = io.ReadFull(conn, reply)
+	utest.IsNilNow(t, err)
+	utest.EqualNow(t, string(reply[:len(codeOK)]), string(codeOK))
+	utest.EqualNow(t, reply[len(codeOK):len(codeOK)+len(data)], data)
+	utest.EqualNow(t, reply[len(codeOK)+len(data):], more)
+}
+
+func Test_BackendAck(t *testing.T) {
+	oldTimeout := cfgAckTimeout
+	cfgBackendAck = true
+	cfgAckTimeout = uint(100 * time.Millisecond)
+	defer func() {
+		cfgBackendAck = false
+		cfgAckTimeout = oldTimeout
+	}()
+
+	// a backend which sends ack and then echoes
+	backend := func(ack []byte) net.Listener {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		utest.IsNilNow(t, err)
+		go func() {
+			for {
+				conn, err := listener.Accept()
+				if err != nil {
+					return
+				}
+				go func() {
+					defer conn.Close()
+					conn.Write(ack)
+					io.Copy(conn, conn)
+				}()
+			}
+		}()
+		return listener
+	}
+	handshake := func(addr string) (net.Conn, string) {
+		conn, err := net.Dial("tcp", cfgGatewayAddr)
+		utest.IsNilNow(t, err)
+		encryptedAddr, err := aes256cbc.EncryptString(string(cfgSecret), addr)
+		utest.IsNilNow(t, err)
+		_, err = conn.Write([]byte(encryptedAddr + "\n"))
+		utest.IsNilNow(t, err)
+		code := make([]byte, 3)
+		_, err = io.ReadFull(conn, code)
+		utest.IsNilNow(t, err)
+		return conn, string(code)
+	}
+
+	good := backend([]byte{0x06})
+	defer good.Close()
+	conn, code := handshake(good.Addr().String())
+	defer conn.Close()
+	utest.EqualNow(t, code, string(codeOK))
+	testEcho(t, conn, 1)
+
+	wrong := backend([]byte("SSH-2.0"))
+	defer wrong.Close()
+	conn2, code := handshake(wrong.Addr().String())
+	defer conn2.Close()
+	utest.EqualNow(t, code, string(codeDialErr))
+
+	// an echo server never sends the ack
+	silent := testEchoServer(t)
+	defer silent.Close()
+	conn3, code := handshake(silent.Addr().String())
+	defer conn3.Close()
+	utest.EqualNow(t, code, string(codeDialErr))
+}
+
+func Test_Candidates(t *testing.T) {
+	// two addresses don't fit in the default handshake size
+	oldSize := cfgHandshake
+	cfgHandshake = 256
+	handshakeBufPool = sync.Pool{New: handshakeBufPool.New}
+	defer func() {
+		cfgHandshake = oldSize
+		handshakeBufPool = sync.Pool{New: handshakeBufPool.New}
+	}()
+
+	listener := testEchoServer(t)
+	defer listener.Close()
+
+	dead, err := net.Listen("tcp", "127.0.0.1:0")
+	utest.IsNilNow(t, err)
+	dead.Close()
+
+	handshake := func(addr string) string {
+		conn, err := net.Dial("tcp", cfgGatewayAddr)
+		utest.IsNilNow(t, err)
+		defer conn.Close()
+
+		encryptedAddr, err := aes256cbc.EncryptString(string(cfgSecret), addr)
+		utest.IsNilNow(t, err)
+		_, err = conn.Write([]byte(encryptedAddr + "\n"))
+		utest.IsNilNow(t, err)
+
+		code := make([]byte, 3)
+		_, err = io.ReadFull(conn, code)
+		utest.IsNilNow(t, err)
+		return string(code)
+	}
+
+	// refused candidate is skipped whichever one is tried first
+	for i := 0; i < 4; i++ {
+		code := handshake(dead.Addr().String() + "," + listener.Addr().String())
+		utest.EqualNow(t, code, string(codeOK))
+	}
+
+	code := handshake(dead.Addr().String() + ", " + dead.Addr().String())
+	utest.EqualNow(t, code, string(codeDialErr))
+}
+
+func Test_AddrMap(t *testing.T) {
+	listener := testEchoServer(t)
+	defer listener.Close()
+
+	file, err := ioutil.TempFile("", "gateway-addr-map")
+	utest.IsNilNow(t, err)
+	defer os.Remove(file.Name())
+	file.WriteString("# services\nservice-a = " + listener.Addr().String() + "\n\nservice-b=127.0.0.1:1, 127.0.0.1:2\n")
+	file.Close()
+
+	cfgAddrMap = file.Name()
+	defer func() {
+		cfgAddrMap, cfgStrictMap = "", false
+		addrMap.Store(map[string]string{})
+	}()
+	utest.IsNilNow(t, loadAddrMap())
+
+	conn := testTunnel(t, "service-a")
+	testEcho(t, conn, 1)
+	conn.Close()
+	targets, err := mapTargets([]string{"service-b", "10.0.0.1:80"})
+	utest.IsNilNow(t, err)
+	utest.EqualNow(t, strings.Join(targets, ","), "127.0.0.1:1,127.0.0.1:2,10.0.0.1:80")
+
+	// only names in the map with -strict-map
+	cfgStrictMap = true
+	_, err = mapTargets([]string{"service-a", "10.0.0.1:80"})
+	utest.EqualNow(t, err, errUnmapped)
+	conn, err = net.Dial("tcp", cfgGatewayAddr)
+	utest.IsNilNow(t, err)
+	defer conn.Close()
+	encryptedAddr, err := aes256cbc.EncryptString(string(cfgSecret), listener.Addr().String())
+	utest.IsNilNow(t, err)
+	_, err = conn.Write([]byte(encryptedAddr + "\n"))
+	utest.IsNilNow(t, err)
+	code := make([]byte, 3)
+	_, err = io.ReadFull(conn, code)
+	utest.IsNilNow(t, err)
+	utest.EqualNow(t, string(code), string(codeBadAddr))
+
+	// a broken file on reload keeps the old map
+	utest.IsNilNow(t, ioutil.WriteFile(file.Name(), []byte("service-c\n"), 0600))
+	reload()
+	_, ok := mappedAddr("service-a")
+	utest.Assert(t, ok)
+	utest.IsNilNow(t, ioutil.WriteFile(file.Name(), []byte("service-c=127.0.0.1:3\n"), 0600))
+	reload()
+	_, ok = mappedAddr("service-a")
+	utest.Assert(t, !ok)
+	addr, _ := mappedAddr("service-c")
+	utest.EqualNow(t, addr, "127.0.0.1:3")
+}
+
+func Test_PprofUnix(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gw")
+	utest.IsNilNow(t, err)
+	defer os.RemoveAll(dir)
+	path := dir + "/admin.sock"
+
+	// socket file left by a crashed gateway
+	stale, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	utest.IsNilNow(t, err)
+	stale.SetUnlinkOnClose(false)
+	stale.Close()
+
+	listener, err := listenPprof("unix:" + path)
+	utest.IsNilNow(t, err)
+	go http.Serve(listener, nil)
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return net.Dial("unix", path)
+		},
+	}}
+	resp, err := client.Get("http://gateway/metrics")
+	utest.IsNilNow(t, err)
+	resp.Body.Close()
+	utest.EqualNow(t, resp.StatusCode, http.StatusOK)
+
+	listener.Close()
+	_, err = os.Stat(path)
+	utest.Assert(t, os.IsNotExist(err))
+
+	// not a socket, left as it is
+	utest.IsNilNow(t, ioutil.WriteFile(path, nil, 0644))
+	_, err = listenPprof("unix:" + path)
+	utest.NotNilNow(t, err)
+}
+
+func Test_UnixBackend(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gw")
+	utest.IsNilNow(t, err)
+	defer os.RemoveAll(dir)
+	path := dir + "/s"
+
+	listener, err := net.Listen("unix", path)
+	utest.IsNilNow(t, err)
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	// forbidden unless listed
+	conn, err := net.Dial("tcp", cfgGatewayAddr)
+	utest.IsNilNow(t, err)
+	encryptedAddr, err := aes256cbc.EncryptString(string(cfgSecret), "unix:"+path)
+	utest.IsNilNow(t, err)
+	_, err = conn.Write([]byte(encryptedAddr + "\n"))
+	utest.IsNilNow(t, err)
+	code := make([]byte, 3)
+	_, err = io.ReadFull(conn, code)
+	utest.IsNilNow(t, err)
+	utest.EqualNow(t, string(code), string(codeForbidden))
+	conn.Close()
+
+	cfgAllowUnix = path
+	utest.IsNilNow(t, setupAllow())
+	defer func() {
+		cfgAllowUnix = ""
+		setupAllow()
+	}()
+	conn = testTunnel(t, "unix:"+path)
+	defer conn.Close()
+	testEcho(t, conn, 10)
+}
+
+func Test_AllowTargets(t *testing.T) {
+	listener := testEchoServer(t)
+	defer listener.Close()
+	_, port, _ := net.SplitHostPort(listener.Addr().String())
+
+	cfgAllowCIDR, cfgAllowPorts = "127.0.0.1, ::1", port
+	utest.IsNilNow(t, setupAllow())
+	defer func() {
+		cfgAllowCIDR, cfgAllowPorts = "", ""
+		setupAllow()
+	}()
+
+	handshake := func(addr string) string {
+		conn, err := net.Dial("tcp", cfgGatewayAddr)
+		utest.IsNilNow(t, err)
+		defer conn.Close()
+
+		encryptedAddr, err := aes256cbc.EncryptString(string(cfgSecret), addr)
+		utest.IsNilNow(t, err)
+		_, err = conn.Write([]byte(encryptedAddr + "\n"))
+		utest.IsNilNow(t, err)
+
+		code := make([]byte, 3)
+		_, err = io.ReadFull(conn, code)
+		utest.IsNilNow(t, err)
+		return string(code)
+	}
+	utest.EqualNow(t, handshake("127.0.0.1:"+port), string(codeOK))
+	utest.EqualNow(t, handshake("localhost:"+port), string(codeOK))
+	utest.EqualNow(t, handshake("127.0.0.2:"+port), string(codeForbidden))
+	utest.EqualNow(t, handshake("127.0.0.1:1"), string(codeForbidden))
+
+	ports, err := parsePorts("80, 8000-8100")
+	utest.IsNilNow(t, err)
+	utest.EqualNow(t, len(ports), 2)
+	utest.EqualNow(t, ports[1], [2]int{8000, 8100})
+	_, err = parsePorts("90-80")
+	utest.NotNilNow(t, err)
+}
+
+func Test_SetupBudget(t *testing.T) {
+	oldProbe, oldBudget := cfgDialProbe, cfgSetupBudget
+	cfgDialProbe = uint(10 * time.Second)
+	cfgSetupBudget = uint(200 * time.Millisecond)
+	defer func() {
+		cfgDialProbe, cfgSetupBudget = oldProbe, oldBudget
+	}()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	utest.IsNilNow(t, err)
+	defer listener.Close()
+
+	// target server is silent, the probe must end with the budget
+	go func() {
+		conn, err := listener.Accept()
+		if err == nil {
+			defer conn.Close()
+			io.Copy(ioutil.Discard, conn)
+		}
+	}()
+
+	conn, err := net.Dial("tcp", cfgGatewayAddr)
+	utest.IsNilNow(t, err)
+	defer conn.Close()
+
+	encryptedAddr, err := aes256cbc.EncryptString(string(cfgSecret), listener.Addr().String())
+	utest.IsNilNow(t, err)
+	_, err = conn.Write([]byte(encryptedAddr + "\n"))
+	utest.IsNilNow(t, err)
+
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	code := make([]byte, 3)
+	_, err = io.ReadFull(conn, code)
+	utest.IsNilNow(t, err)
+	utest.EqualNow(t, string(code), string(codeOK))
+}
+
+func Test_SlowClient(t *testing.T) {
+	oldStall := cfgWriteStall
+	cfgWriteStall = uint(200 * time.Millisecond)
+	defer func() {
+		cfgWriteStall = oldStall
+	}()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	utest.IsNilNow(t, err)
+	defer listener.Close()
+
+	// target server keeps sending until gateway closed the tunnel
+	closed := make(chan struct{})
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		buf := make([]byte, 64*1024)
+		for {
+			if _, err := conn.Write(buf); err != nil {
+				close(closed)
+				return
+			}
+		}
+	}()
+
+	conn, err := net.Dial("tcp", cfgGatewayAddr)
+	utest.IsNilNow(t, err)
+	defer conn.Close()
+
+	encryptedAddr, err := aes256cbc.EncryptString(string(cfgSecret), listener.Addr().String())
+	utest.IsNilNow(t, err)
+	_, err = conn.Write([]byte(encryptedAddr + "\n"))
+	utest.IsNilNow(t, err)
+
+	// client never reads
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("slow client not closed")
+	}
+}
+
+func Test_BackendWriteTimeout(t *testing.T) {
+	cfgAgentWrite, cfgAgentProxy = uint(100*time.Millisecond), true
+	defer func() {
+		cfgAgentWrite, cfgAgentProxy = 0, false
+	}()
+
+	listener := testEchoServer(t)
+	defer listener.Close()
+
+	conn, err := net.Dial("tcp", cfgGatewayAddr)
+	utest.IsNilNow(t, err)
+	defer conn.Close()
+	encryptedAddr, err := aes256cbc.EncryptString(string(cfgSecret), listener.Addr().String())
+	utest.IsNilNow(t, err)
+	_, err = conn.Write([]byte(encryptedAddr + "\nabc"))
+	utest.IsNilNow(t, err)
+
+	header := proxyHeaderV1(conn.LocalAddr(), conn.RemoteAddr())
+	b := make([]byte, len(codeOK)+len(header)+3)
+	_, err = io.ReadFull(conn, b)
+	utest.IsNilNow(t, err)
+	utest.EqualNow(t, string(b), string(codeOK)+string(header)+"abc")
+
+	// the deadline doesn't outlive the handshake
+	time.Sleep(200 * time.Millisecond)
+	testEcho(t, conn, 10)
+}
+
+func Test_ConnLimits(t *testing.T) {
+	listener := testEchoServer(t)
+	defer listener.Close()
+
+	closed := func(conn net.Conn) bool {
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		_, err := ioutil.ReadAll(conn)
+		ne, ok := err.(net.Error)
+		return !ok || !ne.Timeout()
+	}
+
+	cfgMaxBytes = 1000
+	conn := testTunnel(t, listener.Addr().String())
+	b := make([]byte, 400)
+	_, err := conn.Write(b)
+	utest.IsNilNow(t, err)
+	_, err = io.ReadFull(conn, b)
+	utest.IsNilNow(t, err)
+	// 800 relayed, 400 more is over the limit
+	conn.Write(b)
+	utest.Assert(t, closed(conn))
+	conn.Close()
+	cfgMaxBytes = 0
+
+	cfgMaxLife = uint(200 * time.Millisecond)
+	defer func() {
+		cfgMaxLife = 0
+	}()
+	conn = testTunnel(t, listener.Addr().String())
+	defer conn.Close()
+	testEcho(t, conn, 1)
+	start := time.Now()
+	utest.Assert(t, closed(conn))
+	utest.Assert(t, time.Since(start) < time.Second)
+}
+
+func Test_IdleTimeout(t *testing.T) {
+	oldIdle := cfgIdleTimeout
+	cfgIdleTimeout = uint(200 * time.Millisecond)
+	defer func() {
+		cfgIdleTimeout = oldIdle
+	}()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	utest.IsNilNow(t, err)
+	defer listener.Close()
+
+	// target server only sends for a while, then goes silent
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for i := 0; i < 10; i++ {
+			conn.Write([]byte("x"))
+			time.Sleep(100 * time.Millisecond)
+		}
+		ioutil.ReadAll(conn)
+	}()
+
+	conn, err := net.Dial("tcp", cfgGatewayAddr)
+	utest.IsNilNow(t, err)
+	defer conn.Close()
+
+	encryptedAddr, err := aes256cbc.EncryptString(string(cfgSecret), listener.Addr().String())
+	utest.IsNilNow(t, err)
+	_, err = conn.Write([]byte(encryptedAddr + "\n"))
+	utest.IsNilNow(t, err)
+
+	// one way data keeps the tunnel open although client never sends
+	start := time.Now()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	data, err := ioutil.ReadAll(conn)
+	utest.IsNilNow(t, err)
+	utest.EqualNow(t, string(data), string(codeOK)+"xxxxxxxxxx")
+	utest.Assert(t, time.Since(start) > time.Second)
+}
+
+func Test_StalledTarget(t *testing.T) {
+	oldStall := cfgWriteStall
+	cfgWriteStall = uint(200 * time.Millisecond)
+	defer func() {
+		cfgWriteStall = oldStall
+	}()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	utest.IsNilNow(t, err)
+	defer listener.Close()
+
+	// target server holds the connection but never reads or writes
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		accepted <- conn
+	}()
+	defer func() {
+		select {
+		case conn := <-accepted:
+			conn.Close()
+		default:
+		}
+	}()
+
+	conn, err := net.Dial("tcp", cfgGatewayAddr)
+	utest.IsNilNow(t, err)
+	defer conn.Close()
+
+	encryptedAddr, err := aes256cbc.EncryptString(string(cfgSecret), listener.Addr().String())
+	utest.IsNilNow(t, err)
+	_, err = conn.Write([]byte(encryptedAddr + "\n"))
+	utest.IsNilNow(t, err)
+
+	code := make([]byte, len(codeOK))
+	_, err = io.ReadFull(conn, code)
+	utest.IsNilNow(t, err)
+	utest.EqualNow(t, string(code), string(codeOK))
+
+	// client keeps sending until gateway closed the tunnel
+	go func() {
+		buf := make([]byte, 64*1024)
+		for {
+			if _, err := conn.Write(buf); err != nil {
+				return
+			}
+		}
+	}()
+
+	closed := make(chan struct{})
+	go func() {
+		ioutil.ReadAll(conn)
+		close(closed)
+	}()
+
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("stalled target not closed")
+	}
+}
+
+type TestAddr string
+
+func (a TestAddr) Network() string { return "tcp" }
+func (a TestAddr) String() string  { return string(a) }
+
+func Test_AddrIP(t *testing.T) {
+	nets, err := parseCIDRs("1.2.3.0/24, 2001:db8::1")
+	utest.IsNilNow(t, err)
+
+	for _, addr := range []net.Addr{
+		&net.TCPAddr{IP: net.ParseIP("1.2.3.4"), Port: 80},
+		&net.TCPAddr{IP: net.ParseIP("::ffff:1.2.3.4"), Port: 80},
+		TestAddr("1.2.3.4:80"),
+		TestAddr("[::ffff:1.2.3.4]:80"),
+	} {
+		ip, err := addrIP(addr)
+		utest.IsNilNow(t, err)
+		utest.EqualNow(t, len(ip), net.IPv4len)
+		utest.EqualNow(t, ip.String(), "1.2.3.4")
+		utest.Assert(t, containsIP(nets, ip))
+	}
+
+	ip, err := addrIP(TestAddr("[2001:db8::1]:80"))
+	utest.IsNilNow(t, err)
+	utest.EqualNow(t, len(ip), net.IPv6len)
+	utest.Assert(t, containsIP(nets, ip))
+
+	_, err = addrIP(TestAddr("@unix"))
+	utest.NotNilNow(t, err)
+}
+
+func Test_RetryAfter(t *testing.T) {
+	setMaintenance(true)
+	cfgRetryMaint = 30
+	defer func() {
+		setMaintenance(false)
+		cfgRetryMaint = 0
+	}()
+
+	conn, err := net.Dial("tcp", cfgGatewayAddr)
+	utest.IsNilNow(t, err)
+	defer conn.Close()
+
+	reply, err := ioutil.ReadAll(conn)
+	utest.IsNilNow(t, err)
+	utest.EqualNow(t, string(reply), string(codeUnavailable)+" retry-after=30\n")
+}
+
+func testEchoServer(t testing.TB) net.Listener {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	utest.IsNilNow(t, err)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return listener
+}
+
+func testTunnel(t testing.TB, target string) net.Conn {
+	conn, err := net.Dial("tcp", cfgGatewayAddr)
+	utest.IsNilNow(t, err)
+
+	encryptedAddr, err := aes256cbc.EncryptString(string(cfgSecret), target)
+	utest.IsNilNow(t, err)
+	_, err = conn.Write([]byte(encryptedAddr + "\n"))
+	utest.IsNilNow(t, err)
+
+	code := make([]byte, 3)
+	_, err = io.ReadFull(conn, code)
+	utest.IsNilNow(t, err)
+	utest.EqualNow(t, string(code), string(codeOK))
+	return conn
+}
+
+func testEcho(t testing.TB, conn net.Conn, n int) {
+	for j := 0; j < n; j++ {
+		b1 := RandBytes(256)
+		_, err := conn.Write(b1)
+		utest.IsNilNow(t, err)
+
+		b2 := make([]byte, len(b1))
+		_, err = io.ReadFull(conn, b2)
+		utest.IsNilNow(t, err)
+		utest.EqualNow(t, b1, b2)
+	}
+}
+
+func Test_HalfClose(t *testing.T) {
+	listener := testEchoServer(t)
+	defer listener.Close()
+
+	conn := testTunnel(t, listener.Addr().String())
+	defer conn.Close()
+
+	// the request ends with EOF, echo server answers after it
+	b1 := RandBytes(256 * 1024)
+	go func() {
+		conn.Write(b1)
+		conn.(*net.TCPConn).CloseWrite()
+	}()
+
+	b2, err := ioutil.ReadAll(conn)
+	utest.IsNilNow(t, err)
+	utest.EqualNow(t, len(b2), len(b1))
+	utest.Assert(t, bytes.Equal(b1, b2))
+}
+
+func Test_Poll(t *testing.T) {
+	cfgPoll = true
+	defer func() {
+		cfgPoll = false
+	}()
+
+	listener := testEchoServer(t)
+	defer listener.Close()
+
+	for i := 0; i < 10; i++ {
+		conn := testTunnel(t, listener.Addr().String())
+		testEcho(t, conn, 100)
+
+		// large writes exceed socket buffers and go through EPOLLOUT
+		big := RandBytes(1024 * 1024)
+		go conn.Write(big)
+		back := make([]byte, len(big))
+		_, err := io.ReadFull(conn, back)
+		utest.IsNilNow(t, err)
+		utest.Assert(t, bytes.Equal(big, back))
+		conn.Close()
+	}
+
+	// EOF of the request is passed on, the response still comes back
+	conn := testTunnel(t, listener.Addr().String())
+	defer conn.Close()
+	b1 := RandBytes(256 * 1024)
+	go func() {
+		conn.Write(b1)
+		conn.(*net.TCPConn).CloseWrite()
+	}()
+	b2, err := ioutil.ReadAll(conn)
+	utest.IsNilNow(t, err)
+	utest.Assert(t, bytes.Equal(b1, b2))
+
+	// cancelled sessions are closed though the poller has fds of its own
+	conn2 := testTunnel(t, listener.Addr().String())
+	defer conn2.Close()
+	testEcho(t, conn2, 1)
+	closeSessions()
+	conn2.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, err = ioutil.ReadAll(conn2)
+	utest.IsNilNow(t, err)
+
+	// and so are the ones reaching -max-conn-duration
+	oldLife := cfgMaxLife
+	cfgMaxLife = uint(200 * time.Millisecond)
+	defer func() {
+		cfgMaxLife = oldLife
+	}()
+	conn3 := testTunnel(t, listener.Addr().String())
+	defer conn3.Close()
+	testEcho(t, conn3, 1)
+	conn3.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, err = ioutil.ReadAll(conn3)
+	utest.IsNilNow(t, err)
+}
+
+// an idle tunnel under -poll has only the goroutine of the connection, and
+// the one of the echo server, without it three of the gateway
+func Test_PollGoroutines(t *testing.T) {
+	listener := testEchoServer(t)
+	defer listener.Close()
+
+	count := func() int {
+		before := runtime.NumGoroutine()
+		var conns []net.Conn
+		for i := 0; i < 20; i++ {
+			conn := testTunnel(t, listener.Addr().String())
+			testEcho(t, conn, 1)
+			conns = append(conns, conn)
+		}
+		time.Sleep(100 * time.Millisecond)
+		n := runtime.NumGoroutine() - before
+		for _, conn := range conns {
+			conn.Close()
+		}
+		time.Sleep(100 * time.Millisecond)
+		return n
+	}
+
+	utest.Assert(t, count() >= 20*3)
+	cfgPoll = true
+	defer func() {
+		cfgPoll = false
+	}()
+	utest.Assert(t, count() <= 20*2+2)
+}
+
+func Test_CloseSessions(t *testing.T) {
+	listener := testEchoServer(t)
+	defer listener.Close()
+
+	conn := testTunnel(t, listener.Addr().String())
+	defer conn.Close()
+	testEcho(t, conn, 1)
+
+	closeSessions()
+
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, err := ioutil.ReadAll(conn)
+	utest.IsNilNow(t, err)
+}
+
+func Test_CancelGateway(t *testing.T) {
+	ctx, cancel := gatewayCtx, cancelGateway
+	gatewayCtx, cancelGateway = context.WithCancel(context.Background())
+	defer func() {
+		gatewayCtx, cancelGateway = ctx, cancel
+	}()
+
+	listener := testEchoServer(t)
+	defer listener.Close()
+
+	conn := testTunnel(t, listener.Addr().String())
+	defer conn.Close()
+	testEcho(t, conn, 1)
+
+	cancelGateway()
+
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, err := ioutil.ReadAll(conn)
+	utest.IsNilNow(t, err)
+}
+
+func Test_LogFormat(t *testing.T) {
+	s := newSession(&net.TCPConn{})
+	s.client = TestAddr("1.2.3.4:5678")
+	s.target = "10.0.0.1:80"
+
+	var entry logEntry
+	utest.IsNilNow(t, json.Unmarshal(formatLog("warn", s, codeDialErr, "Dial failed"), &entry))
+	utest.EqualNow(t, entry.Level, "warn")
+	utest.EqualNow(t, entry.Msg, "Dial failed")
+	utest.EqualNow(t, entry.ConnID, s.id)
+	utest.EqualNow(t, entry.RemoteAddr, "1.2.3.4:5678")
+	utest.EqualNow(t, entry.ClientIP, "1.2.3.4")
+	utest.EqualNow(t, entry.BackendAddr, "10.0.0.1:80")
+	utest.EqualNow(t, entry.Code, "502")
+
+	s.client = TestAddr("[2001:db8::1]:5678")
+	utest.IsNilNow(t, json.Unmarshal(formatLog("warn", s, nil, "Dial failed"), &entry))
+	utest.EqualNow(t, entry.ClientIP, "2001:db8::1")
+
+	// lines not about a connection have no connection fields
+	line := string(formatLog("info", nil, nil, "Gateway killed"))
+	utest.Assert(t, !strings.Contains(line, "conn_id"))
+	utest.Assert(t, !strings.Contains(line, "code"))
+}
+
+func Test_AccessLog(t *testing.T) {
+	listener := testEchoServer(t)
+	defer listener.Close()
+
+	conn := testTunnel(t, listener.Addr().String())
+	defer conn.Close()
+	testEcho(t, conn, 1)
+
+	// the download counter is updated right after the write returned
+	time.Sleep(100 * time.Millisecond)
+
+	var s *session
+	sessions.Lock()
+	for _, session := range sessions.m {
+		if session.target == listener.Addr().String() {
+			s = session
+		}
+	}
+	sessions.Unlock()
+	utest.NotNilNow(t, s)
+
+	var entry accessEntry
+	utest.IsNilNow(t, json.Unmarshal(formatAccess(s), &entry))
+	utest.EqualNow(t, entry.Msg, "Access")
+	utest.EqualNow(t, entry.ConnID, s.id)
+	utest.EqualNow(t, entry.BackendAddr, listener.Addr().String())
+	utest.EqualNow(t, entry.Code, "200")
+	utest.Assert(t, entry.DialTime > 0)
+	utest.Assert(t, entry.Duration >= entry.DialTime)
+	utest.Assert(t, entry.Upload > 0)
+	utest.EqualNow(t, entry.Download, entry.Upload)
+}
+
+func Test_Healthz(t *testing.T) {
+	w := httptest.NewRecorder()
+	healthHandler(w, httptest.NewRequest("GET", "/healthz", nil))
+	utest.EqualNow(t, w.Code, 200)
+
+	listener := testEchoServer(t)
+	cfgHealthAddr = listener.Addr().String()
+	defer func() {
+		cfgHealthAddr = ""
+		health.checked = time.Time{}
+	}()
+
+	w = httptest.NewRecorder()
+	healthHandler(w, httptest.NewRequest("GET", "/healthz", nil))
+	utest.EqualNow(t, w.Code, 200)
+
+	// the result is cached for a while after the backend is down
+	listener.Close()
+	w = httptest.NewRecorder()
+	healthHandler(w, httptest.NewRequest("GET", "/healthz", nil))
+	utest.EqualNow(t, w.Code, 200)
+
+	health.checked = time.Time{}
+	w = httptest.NewRecorder()
+	healthHandler(w, httptest.NewRequest("GET", "/healthz", nil))
+	utest.EqualNow(t, w.Code, 503)
+	utest.EqualNow(t, w.Body.String(), "backend unreachable\n")
+}
+
+type panicConn struct {
+	net.Conn
+}
+
+func (panicConn) Read([]byte) (int, error) {
+	panic("read panic")
+}
+
+func Test_Panic(t *testing.T) {
+	panics := atomic.LoadUint64(&recoveredPanics)
+
+	client, server := net.Pipe()
+	defer client.Close()
+	go handle(panicConn{server})
+
+	b, err := ioutil.ReadAll(client)
+	utest.IsNilNow(t, err)
+	utest.EqualNow(t, string(b), string(codeInternal))
+	utest.EqualNow(t, atomic.LoadUint64(&recoveredPanics), panics+1)
+}
+
+func Test_Metrics(t *testing.T) {
+	// one failed and one succeed handshake
+	conn, err := net.Dial("tcp", cfgGatewayAddr)
+	utest.IsNilNow(t, err)
+	conn.Write([]byte("abc\n"))
+	ioutil.ReadAll(conn)
+	conn.Close()
+
+	listener := testEchoServer(t)
+	defer listener.Close()
+	conn = testTunnel(t, listener.Addr().String())
+	defer conn.Close()
+	testEcho(t, conn, 1)
+
+	w := httptest.NewRecorder()
+	metricsHandler(w, httptest.NewRequest("GET", "/metrics", nil))
+	metrics := w.Body.String()
+
+	for _, line := range []string{
+		"# TYPE gateway_connections_total counter\n",
+		"gateway_active_connections ",
+		"gateway_handshake_failures_total{code=\"401\"} ",
+		"gateway_dial_duration_seconds_bucket{le=\"0.001\"} ",
+		"gateway_dial_duration_seconds_bucket{le=\"+Inf\"} ",
+		"gateway_bytes_total{direction=\"upload\"} ",
+		"gateway_decrypt_duration_seconds_sum ",
+	} {
+		utest.Assert(t, strings.Contains(metrics, line))
+	}
+	utest.Assert(t, !strings.Contains(metrics, "gateway_dial_duration_seconds_count 0\n"))
+	utest.Assert(t, !strings.Contains(metrics, "gateway_decrypt_duration_seconds_count 0\n"))
+	utest.Assert(t, !strings.Contains(metrics, "gateway_handshake_failures_total{code=\"401\"} 0\n"))
+}
+
+// testGeoIP maps client IPs to countries, IPs not in it have no country like
+// the reserved ranges in a real database.
+type testGeoIP map[string]string
+
+func (db testGeoIP) Lookup(ip net.IP, result interface{}) error {
+	result.(*geoipRecord).Country.ISOCode = db[ip.String()]
+	return nil
+}
+
+func (db testGeoIP) Close() error { return nil }
+
+func Test_GeoIP(t *testing.T) {
+	oldPath, oldOpen := cfgGeoIPPath, cfgGeoIPOpen
+	defer func() {
+		cfgGeoIPPath, cfgGeoIPOpen = oldPath, oldOpen
+		geoipDB, geoipBlocked = nil, nil
+	}()
+	cfgGeoIPPath = "test.mmdb"
+	geoipDB = testGeoIP{"1.2.3.4": "US", "5.6.7.8": "KP"}
+	geoipBlocked = map[string]bool{"KP": true}
+
+	client := func(ip string) net.Addr {
+		return &net.TCPAddr{IP: net.ParseIP(ip), Port: 1234}
+	}
+	counter := func(m *expvar.Map, country string) int64 {
+		if v, ok := m.Get(country).(*expvar.Int); ok {
+			return v.Value()
+		}
+		return 0
+	}
+
+	accepted, rejected := counter(geoipAccept, "US"), counter(geoipReject, "KP")
+	utest.Assert(t, geoipAllow(client("1.2.3.4")))
+	utest.Assert(t, !geoipAllow(client("5.6.7.8")))
+	utest.EqualNow(t, counter(geoipAccept, "US"), accepted+1)
+	utest.EqualNow(t, counter(geoipReject, "KP"), rejected+1)
+
+	// no country in the database
+	unknown := counter(geoipAccept, "unknown")
+	utest.Assert(t, geoipAllow(client("10.0.0.1")))
+	utest.EqualNow(t, counter(geoipAccept, "unknown"), unknown+1)
+	geoipBlocked["unknown"] = true
+	utest.Assert(t, !geoipAllow(client("10.0.0.1")))
+
+	// lookup failed, e.g. a client of a Unix socket
+	unix := &net.UnixAddr{Name: "/var/run/gateway.sock", Net: "unix"}
+	utest.Assert(t, geoipAllow(unix))
+	cfgGeoIPOpen = false
+	utest.Assert(t, !geoipAllow(unix))
+
+	w := httptest.NewRecorder()
+	metricsHandler(w, httptest.NewRequest("GET", "/metrics", nil))
+	metrics := w.Body.String()
+	for _, line := range []string{
+		"# TYPE gateway_geoip_total counter\n",
+		"gateway_geoip_total{country=\"US\",result=\"accept\"} ",
+		"gateway_geoip_total{country=\"KP\",result=\"reject\"} ",
+		"gateway_geoip_total{country=\"unknown\",result=\"reject\"} ",
+		"gateway_geoip_total{country=\"error\",result=\"accept\"} ",
+	} {
+		utest.Assert(t, strings.Contains(metrics, line))
+	}
+}
+
+func Test_CloseReasons(t *testing.T) {
+	waitCount := func(reason int32, n uint64) {
+		for i := 0; i < 200 && atomic.LoadUint64(&closeCounts[reason]) < n; i++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+		utest.EqualNow(t, atomic.LoadUint64(&closeCounts[reason]), n)
+	}
+
+	// client closes first
+	listener := testEchoServer(t)
+	defer listener.Close()
+	n := atomic.LoadUint64(&closeCounts[closeClientEOF])
+	conn := testTunnel(t, listener.Addr().String())
+	testEcho(t, conn, 1)
+	conn.Close()
+	waitCount(closeClientEOF, n+1)
+
+	// target server closes first
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	utest.IsNilNow(t, err)
+	defer backend.Close()
+	go func() {
+		for {
+			c, err := backend.Accept()
+			if err != nil {
+				return
+			}
+			c.Close()
+		}
+	}()
+	n = atomic.LoadUint64(&closeCounts[closeBackendEOF])
+	conn = testTunnel(t, backend.Addr().String())
+	ioutil.ReadAll(conn)
+	conn.Close()
+	waitCount(closeBackendEOF, n+1)
+
+	// limits
+	cfgMaxBytes = 100
+	n = atomic.LoadUint64(&closeCounts[closeByteCap])
+	conn = testTunnel(t, listener.Addr().String())
+	conn.Write(make([]byte, 200))
+	ioutil.ReadAll(conn)
+	conn.Close()
+	cfgMaxBytes = 0
+	waitCount(closeByteCap, n+1)
+
+	w := httptest.NewRecorder()
+	metricsHandler(w, httptest.NewRequest("GET", "/metrics", nil))
+	utest.Assert(t, strings.Contains(w.Body.String(), "gateway_connection_close_total{reason=\"backend_eof\"} "))
+	utest.Assert(t, !strings.Contains(w.Body.String(), "reason=\"unknown\""))
+}
+
+func Test_TuneConn(t *testing.T) {
+	cfgKeepAlive, cfgNoDelay = 30, false
+	defer func() {
+		cfgKeepAlive, cfgNoDelay = -1, true
+	}()
+
+	listener := testEchoServer(t)
+	defer listener.Close()
+
+	conn := testTunnel(t, listener.Addr().String())
+	defer conn.Close()
+	testEcho(t, conn, 10)
+
+	// not TCP, nothing to set
+	udp, err := net.ListenPacket("udp", "127.0.0.1:0")
+	utest.IsNilNow(t, err)
+	defer udp.Close()
+	tuneConn(udp.(*net.UDPConn))
+}
+
+func Test_Pool(t *testing.T) {
+	cfgPoolSize = 2
+	defer func() {
+		cfgPoolSize = 0
+		poolSweep(time.Now().Add(time.Hour))
+	}()
+
+	listener := testEchoServer(t)
+	defer listener.Close()
+	addr := listener.Addr().String()
+	pooled := func() int {
+		agentPool.Lock()
+		defer agentPool.Unlock()
+		return len(agentPool.idle[addr])
+	}
+
+	misses := poolMisses.Value()
+	conn := testTunnel(t, addr)
+	testEcho(t, conn, 1)
+	conn.Close()
+	utest.EqualNow(t, poolMisses.Value(), misses+1)
+
+	for i := 0; i < 100 && pooled() < 2; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	utest.EqualNow(t, pooled(), 2)
+
+	hits := poolHits.Value()
+	conn = testTunnel(t, addr)
+	testEcho(t, conn, 10)
+	conn.Close()
+	utest.EqualNow(t, poolHits.Value(), hits+1)
+
+	// unused connections go away after -pool-idle
+	poolSweep(time.Now().Add(time.Duration(cfgPoolIdle)))
+	utest.EqualNow(t, pooled(), 0)
+}
+
+func Test_PoolHealthy(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	utest.IsNilNow(t, err)
+	defer listener.Close()
+
+	pair := func() (net.Conn, net.Conn) {
+		conn, err := net.Dial("tcp", listener.Addr().String())
+		utest.IsNilNow(t, err)
+		peer, err := listener.Accept()
+		utest.IsNilNow(t, err)
+		return conn, peer
+	}
+
+	conn, peer := pair()
+	utest.Assert(t, poolHealthy(conn))
+
+	// the check doesn't wait for a read
+	start := time.Now()
+	for i := 0; i < 100; i++ {
+		poolHealthy(conn)
+	}
+	utest.Assert(t, time.Since(start) < 50*time.Millisecond)
+
+	peer.Write([]byte("hello"))
+	time.Sleep(10 * time.Millisecond)
+	utest.Assert(t, !poolHealthy(conn))
+	conn.Close()
+	peer.Close()
+
+	conn, peer = pair()
+	peer.Close()
+	time.Sleep(10 * time.Millisecond)
+	utest.Assert(t, !poolHealthy(conn))
+	conn.Close()
+}
+
+func Test_RateLimit(t *testing.T) {
+	cfgRateLimit, cfgRateBurst = 1, 2
+	defer func() {
+		cfgRateLimit, cfgRateBurst = 0, 0
+		rateBuckets.Lock()
+		rateBuckets.m = make(map[string]*rateBucket)
+		rateBuckets.Unlock()
+	}()
+
+	listener := testEchoServer(t)
+	defer listener.Close()
+
+	for i := 0; i < 2; i++ {
+		conn := testTunnel(t, listener.Addr().String())
+		testEcho(t, conn, 1)
+		conn.Close()
+	}
+
+	rejects := rateRejects.Value()
+	conn, err := net.Dial("tcp", cfgGatewayAddr)
+	utest.IsNilNow(t, err)
+	defer conn.Close()
+	b, _ := ioutil.ReadAll(conn)
+	utest.EqualNow(t, len(b), 0)
+	utest.EqualNow(t, rateRejects.Value(), rejects+1)
+
+	// refilled buckets are removed
+	rateSweep(time.Now())
+	utest.EqualNow(t, len(rateBuckets.m), 1)
+	rateSweep(time.Now().Add(2 * time.Second))
+	utest.EqualNow(t, len(rateBuckets.m), 0)
+}
+
+func Test_Linger(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	utest.IsNilNow(t, err)
+	defer listener.Close()
+
+	// the error the client reads after the gateway force closed its side
+	closed := func(wrap func(net.Conn) net.Conn) error {
+		client, err := net.Dial("tcp", listener.Addr().String())
+		utest.IsNilNow(t, err)
+		defer client.Close()
+		server, err := listener.Accept()
+		utest.IsNilNow(t, err)
+		forceClose(wrap(server))
+		client.SetReadDeadline(time.Now().Add(2 * time.Second))
+		_, err = client.Read(make([]byte, 1))
+		return err
+	}
+	plain := func(conn net.Conn) net.Conn { return conn }
+	withTLS := func(conn net.Conn) net.Conn { return tls.Server(conn, &tls.Config{}) }
+
+	utest.EqualNow(t, closed(plain), io.EOF)
+
+	// -linger 0 resets the connection, below TLS too
+	cfgLinger = 0
+	defer func() {
+		cfgLinger = -1
+	}()
+	for _, wrap := range []func(net.Conn) net.Conn{plain, withTLS} {
+		err := closed(wrap)
+		utest.Assert(t, err != nil && err != io.EOF)
+		utest.Assert(t, strings.Contains(err.Error(), "reset"))
+	}
+}
+
+func Test_MaxConns(t *testing.T) {
+	oldSlots, oldReject, oldRetry := connSlots, cfgFullReject, cfgRetryFull
+	connSlots, cfgFullReject, cfgRetryFull = make(chan struct{}, 1), true, 5
+	// -linger 0 doesn't reset the connection before the code arrives
+	cfgLinger = 0
+	defer func() {
+		connSlots, cfgFullReject, cfgRetryFull = oldSlots, oldReject, oldRetry
+		cfgLinger = -1
+	}()
+
+	listener := testEchoServer(t)
+	defer listener.Close()
+
+	conn := testTunnel(t, listener.Addr().String())
+	testEcho(t, conn, 1)
+
+	conn2, err := net.Dial("tcp", cfgGatewayAddr)
+	utest.IsNilNow(t, err)
+	defer conn2.Close()
+	conn2.SetReadDeadline(time.Now().Add(2 * time.Second))
+	reply, err := ioutil.ReadAll(conn2)
+	utest.IsNilNow(t, err)
+	utest.EqualNow(t, string(reply), string(codeUnavailable)+" retry-after=5\n")
+
+	// the slot is free again after the first connection closed
+	conn.Close()
+	for len(connSlots) > 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+	conn3 := testTunnel(t, listener.Addr().String())
+	defer conn3.Close()
+	testEcho(t, conn3, 1)
+}
+
+func Test_BackendProxyProtocol(t *testing.T) {
+	cfgAgentProxy = true
+	defer func() {
+		cfgAgentProxy = false
+	}()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	utest.IsNilNow(t, err)
+	defer listener.Close()
+
+	clients := make(chan net.Addr, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		client, _ := readProxyHeader(conn)
+		clients <- client
+		io.Copy(conn, conn)
+	}()
+
+	conn := testTunnel(t, listener.Addr().String())
+	defer conn.Close()
+	testEcho(t, conn, 1)
+
+	client := (<-clients).(*net.TCPAddr)
+	local := conn.LocalAddr().(*net.TCPAddr)
+	utest.Assert(t, client.IP.Equal(local.IP))
+	utest.EqualNow(t, client.Port, local.Port)
+}
+
+func Test_Cipher(t *testing.T) {
+	gatewayCipher = chachaPoly{}
+	defer func() {
+		gatewayCipher = aesCBC{}
+	}()
+
+	listener := testEchoServer(t)
+	defer listener.Close()
+
+	handshake := func(data []byte) string {
+		conn, err := net.Dial("tcp", cfgGatewayAddr)
+		utest.IsNilNow(t, err)
+		defer conn.Close()
+		_, err = conn.Write([]byte(base64.StdEncoding.EncodeToString(data) + "\n"))
+		utest.IsNilNow(t, err)
+		code := make([]byte, 3)
+		_, err = io.ReadFull(conn, code)
+		utest.IsNilNow(t, err)
+		return string(code)
+	}
+
+	data, err := chachaPoly{}.Encrypt(cfgSecret, []byte(listener.Addr().String()))
+	utest.IsNilNow(t, err)
+	utest.EqualNow(t, handshake(data), string(codeOK))
+
+	// any change of the ciphertext is detected
+	data[len(data)-1] ^= 1
+	utest.EqualNow(t, handshake(data), string(codeBadAddr))
+
+	// clients of the other cipher and passphrase never get through
+	data, err = aesCBC{}.Encrypt(cfgSecret, []byte(listener.Addr().String()))
+	utest.IsNilNow(t, err)
+	utest.EqualNow(t, handshake(data), string(codeBadAddr))
+	data, err = chachaPoly{}.Encrypt([]byte("wrong"), []byte(listener.Addr().String()))
+	utest.IsNilNow(t, err)
+	utest.EqualNow(t, handshake(data), string(codeBadAddr))
+
+	_, err = chachaPoly{}.Decrypt(cfgSecret, []byte("Salted__"))
+	utest.EqualNow(t, err, errChachaMagic)
+
+	cfgCipher = "rot13"
+	defer func() {
+		cfgCipher = "aes-256-cbc"
+	}()
+	utest.NotNilNow(t, setupCipher())
+}
+
+func Test_RequireMAC(t *testing.T) {
+	cfgRequireMAC = true
+	defer func() {
+		cfgRequireMAC = false
+	}()
+
+	seal := func(secret []byte, addr string) []byte {
+		ciphertext, err := aesCBC{}.Encrypt(secret, []byte(addr))
+		utest.IsNilNow(t, err)
+		mac := hmac.New(sha256.New, handshakeMACKey(secret))
+		mac.Write(ciphertext)
+		return append(ciphertext, mac.Sum(nil)...)
+	}
+	encode := base64.StdEncoding.EncodeToString
+
+	data := seal(cfgSecret, "127.0.0.1:80")
+	addr, err := decryptAddr([]byte(encode(data)))
+	utest.IsNilNow(t, err)
+	utest.EqualNow(t, string(addr), "127.0.0.1:80")
+
+	// tampered ciphertext is rejected before decrypt
+	data[len(data)-sha256.Size-1] ^= 1
+	_, err = decryptAddr([]byte(encode(data)))
+	utest.EqualNow(t, err, errBadMAC)
+
+	_, err = decryptAddr([]byte(encode(seal([]byte("wrong"), "127.0.0.1:80"))))
+	utest.EqualNow(t, err, errBadMAC)
+
+	// clients without the MAC
+	data, err = aesCBC{}.Encrypt(cfgSecret, []byte("127.0.0.1:80"))
+	utest.IsNilNow(t, err)
+	_, err = decryptAddr([]byte(encode(data)))
+	utest.EqualNow(t, err, errBadMAC)
+	_, err = decryptAddr([]byte(encode([]byte("short"))))
+	utest.EqualNow(t, err, errBadMAC)
+}
+
+func Test_CheckOnly(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gateway-check")
+	utest.IsNilNow(t, err)
+	defer os.RemoveAll(dir)
+
+	oldPidFile := cfgPidFile
+	cfgCheckOnly, cfgPidFile = true, dir+"/gateway.pid"
+	defer func() {
+		cfgCheckOnly, cfgPidFile = false, oldPidFile
+	}()
+
+	// returns instead of serving, and writes nothing
+	main()
+	_, err = os.Stat(cfgPidFile)
+	utest.Assert(t, os.IsNotExist(err))
+
+	cfgAllowCIDR = "10.0.0.0/33"
+	defer func() {
+		cfgAllowCIDR = ""
+		setupAllow()
+	}()
+	func() {
+		defer func() {
+			err := recover()
+			utest.NotNilNow(t, err)
+			utest.Assert(t, strings.Contains(err.(string), "Bad target server allow list"))
+		}()
+		main()
+	}()
+}
+
+func Test_PidFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gateway-pid")
+	utest.IsNilNow(t, err)
+	defer os.RemoveAll(dir)
+	path := dir + "/gateway.pid"
+
+	utest.IsNilNow(t, writePidFile(path, 123))
+	data, err := ioutil.ReadFile(path)
+	utest.IsNilNow(t, err)
+	utest.EqualNow(t, string(data), "123")
+
+	// left by a gateway which is still running
+	utest.IsNilNow(t, ioutil.WriteFile(path, []byte(strconv.Itoa(os.Getppid())+"\n"), 0644))
+	utest.NotNilNow(t, writePidFile(path, 123))
+
+	// left by a crashed one, or garbage
+	utest.IsNilNow(t, ioutil.WriteFile(path, []byte("999999999"), 0644))
+	utest.IsNilNow(t, writePidFile(path, 123))
+	utest.IsNilNow(t, ioutil.WriteFile(path, []byte("garbage"), 0644))
+	utest.IsNilNow(t, writePidFile(path, 123))
+
+	// no temp files left
+	files, err := ioutil.ReadDir(dir)
+	utest.IsNilNow(t, err)
+	utest.EqualNow(t, len(files), 1)
+}
+
+func Test_LoadConfig(t *testing.T) {
+	file, err := ioutil.TempFile("", "gateway-config")
+	utest.IsNilNow(t, err)
+	defer os.Remove(file.Name())
+	file.Close()
+
+	load := func(config string) error {
+		utest.IsNilNow(t, ioutil.WriteFile(file.Name(), []byte(config), 0600))
+		return loadConfig(file.Name())
+	}
+	defer func() {
+		cfgDialRetry, cfgUDP, cfgDumpDir = 1, false, "."
+	}()
+
+	utest.IsNilNow(t, load(`{"retry": 3, "udp": true}`))
+	utest.EqualNow(t, cfgDialRetry, uint(3))
+	utest.EqualNow(t, cfgUDP, true)
+
+	// command line flags win
+	utest.IsNilNow(t, flag.Set("dump-dir", "."))
+	utest.IsNilNow(t, load(`{"dump-dir": "/tmp"}`))
+	utest.EqualNow(t, cfgDumpDir, ".")
+
+	utest.NotNilNow(t, load(`{"no-such-flag": 1}`))
+	utest.NotNilNow(t, load(`{"config": "other.json"}`))
+	utest.NotNilNow(t, load(`{"probe": "many"}`))
+	utest.NotNilNow(t, load(`{"linger": [1, 2]}`))
+	utest.NotNilNow(t, load(`{"probe": 1,}`))
+}
+
+func Test_ReloadSecret(t *testing.T) {
+	file, err := ioutil.TempFile("", "gateway-secret")
+	utest.IsNilNow(t, err)
+	defer os.Remove(file.Name())
+	file.WriteString("rotated\n")
+	file.Close()
+
+	cfgSecretFile = file.Name()
+	defer func() {
+		cfgSecretFile = ""
+		passphrase.Store(cfgSecret)
+	}()
+	reload()
+	utest.EqualNow(t, string(currentSecret()), "rotated")
+
+	listener := testEchoServer(t)
+	defer listener.Close()
+
+	handshake := func(secret string) string {
+		conn, err := net.Dial("tcp", cfgGatewayAddr)
+		utest.IsNilNow(t, err)
+		defer conn.Close()
+
+		encryptedAddr, err := aes256cbc.EncryptString(secret, listener.Addr().String())
+		utest.IsNilNow(t, err)
+		_, err = conn.Write([]byte(encryptedAddr + "\n"))
+		utest.IsNilNow(t, err)
+
+		code := make([]byte, 3)
+		_, err = io.ReadFull(conn, code)
+		utest.IsNilNow(t, err)
+		return string(code)
+	}
+	utest.EqualNow(t, handshake("rotated"), string(codeOK))
+	// a wrong passphrase may decrypt to garbage, which is 502 instead of 401
+	utest.Assert(t, handshake(string(cfgSecret)) != string(codeOK))
+
+	// the previous passphrase is still accepted with -secret-old
+	cfgSecretOld = cfgSecret
+	utest.EqualNow(t, handshake(string(cfgSecret)), string(codeOK))
+	utest.EqualNow(t, handshake("rotated"), string(codeOK))
+	utest.Assert(t, handshake("unknown") != string(codeOK))
+	cfgSecretOld = nil
+
+	// a broken file keeps the current passphrase
+	utest.IsNilNow(t, ioutil.WriteFile(file.Name(), []byte(" \n"), 0600))
+	reload()
+	utest.EqualNow(t, string(currentSecret()), "rotated")
+}
+
+func Test_TLS(t *testing.T) {
+	srv := httptest.NewTLSServer(nil)
+	srv.Close()
+	gatewayTLS = &tls.Config{Certificates: srv.TLS.Certificates}
+	defer func() {
+		gatewayTLS = nil
+	}()
+
+	listener := testEchoServer(t)
+	defer listener.Close()
+
+	conn, err := tls.Dial("tcp", cfgGatewayAddr, &tls.Config{InsecureSkipVerify: true})
+	utest.IsNilNow(t, err)
+	defer conn.Close()
+
+	encryptedAddr, err := aes256cbc.EncryptString(string(cfgSecret), listener.Addr().String())
+	utest.IsNilNow(t, err)
+	_, err = conn.Write([]byte(encryptedAddr + "\n"))
+	utest.IsNilNow(t, err)
+	code := make([]byte, 3)
+	_, err = io.ReadFull(conn, code)
+	utest.IsNilNow(t, err)
+	utest.EqualNow(t, string(code), string(codeOK))
+	testEcho(t, conn, 10)
+
+	cfgTLSCert, cfgTLSKey = "missing.pem", "missing.key"
+	defer func() {
+		cfgTLSCert, cfgTLSKey = "", ""
+	}()
+	utest.NotNilNow(t, setupTLS())
+}
+
+func Test_VersionedReply(t *testing.T) {
+	listener := testEchoServer(t)
+	defer listener.Close()
+
+	handshake := func(version byte, target string) net.Conn {
+		conn, err := net.Dial("tcp", cfgGatewayAddr)
+		utest.IsNilNow(t, err)
+		encryptedAddr, err := aes256cbc.EncryptString(string(cfgSecret), target)
+		utest.IsNilNow(t, err)
+		_, err = conn.Write(append([]byte{versionFlag | version}, encryptedAddr+"\n"...))
+		utest.IsNilNow(t, err)
+		return conn
+	}
+
+	conn := handshake(1, listener.Addr().String())
+	defer conn.Close()
+	reply := make([]byte, 4)
+	_, err := io.ReadFull(conn, reply)
+	utest.IsNilNow(t, err)
+	utest.EqualNow(t, string(reply), "\x01200")
+	testEcho(t, conn, 1)
+
+	conn2 := handshake(2, listener.Addr().String())
+	defer conn2.Close()
+	reply = make([]byte, 5)
+	_, err = io.ReadFull(conn2, reply)
+	utest.IsNilNow(t, err)
+	utest.EqualNow(t, string(reply), "\x02\x03200")
+	testEcho(t, conn2, 1)
+
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	utest.IsNilNow(t, err)
+	addr := closed.Addr().String()
+	closed.Close()
+	conn3 := handshake(2, addr)
+	defer conn3.Close()
+	b, err := ioutil.ReadAll(conn3)
+	utest.IsNilNow(t, err)
+	utest.EqualNow(t, string(b), "\x02\x16502 connection refused")
+
+	// unknown versions get the unversioned code
+	conn4 := handshake(maxVersion+1, addr)
+	defer conn4.Close()
+	b, err = ioutil.ReadAll(conn4)
+	utest.IsNilNow(t, err)
+	utest.EqualNow(t, string(b), string(codeBadReq))
+}
+
+func Test_Compress(t *testing.T) {
+	listener := testEchoServer(t)
+	defer listener.Close()
+
+	handshake := func() (net.Conn, []byte) {
+		conn, err := net.Dial("tcp", cfgGatewayAddr)
+		utest.IsNilNow(t, err)
+		encryptedAddr, err := aes256cbc.EncryptString(string(cfgSecret), listener.Addr().String())
+		utest.IsNilNow(t, err)
+		_, err = conn.Write(append([]byte{versionFlag | compressFlag | 2}, encryptedAddr+"\n"...))
+		utest.IsNilNow(t, err)
+		reply := make([]byte, 5)
+		_, err = io.ReadFull(conn, reply)
+		utest.IsNilNow(t, err)
+		return conn, reply
+	}
+
+	// not allowed, the tunnel is not compressed
+	conn, reply := handshake()
+	utest.EqualNow(t, string(reply), "\x02\x03200")
+	testEcho(t, conn, 1)
+	conn.Close()
+
+	cfgCompress = true
+	defer func() {
+		cfgCompress = false
+	}()
+	conn, reply = handshake()
+	defer conn.Close()
+	utest.EqualNow(t, string(reply), "\x42\x03200")
+
+	zw, err := flate.NewWriter(conn, flate.DefaultCompression)
+	utest.IsNilNow(t, err)
+	zr := flate.NewReader(conn)
+	for i := 0; i < 10; i++ {
+		b1 := bytes.Repeat([]byte("gateway"), 1000)
+		_, err = zw.Write(b1)
+		utest.IsNilNow(t, err)
+		utest.IsNilNow(t, zw.Flush())
+		b2 := make([]byte, len(b1))
+		_, err = io.ReadFull(zr, b2)
+		utest.IsNilNow(t, err)
+		utest.EqualNow(t, b1, b2)
+	}
+
+	// the end of the deflate stream is passed on as EOF, and so back
+	utest.IsNilNow(t, zw.Close())
+	rest, err := ioutil.ReadAll(zr)
+	utest.IsNilNow(t, err)
+	utest.EqualNow(t, len(rest), 0)
+}
+
+func Test_DialTiming(t *testing.T) {
+	listener := testEchoServer(t)
+	defer listener.Close()
+
+	handshake := func(target string) net.Conn {
+		conn, err := net.Dial("tcp", cfgGatewayAddr)
+		utest.IsNilNow(t, err)
+		encryptedAddr, err := aes256cbc.EncryptString(string(cfgSecret), target)
+		utest.IsNilNow(t, err)
+		_, err = conn.Write(append([]byte{versionFlag | timingFlag | 2}, encryptedAddr+"\n"...))
+		utest.IsNilNow(t, err)
+		return conn
+	}
+
+	conn := handshake(listener.Addr().String())
+	defer conn.Close()
+	reply := make([]byte, 5+4)
+	_, err := io.ReadFull(conn, reply)
+	utest.IsNilNow(t, err)
+	utest.EqualNow(t, string(reply[:5]), "\x22\x03200")
+	utest.Assert(t, binary.BigEndian.Uint32(reply[5:]) < uint32(cfgDialTimeout/uint(time.Millisecond)))
+	testEcho(t, conn, 1)
+
+	// failed handshakes have no dial time
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	utest.IsNilNow(t, err)
+	addr := closed.Addr().String()
+	closed.Close()
+	conn2 := handshake(addr)
+	defer conn2.Close()
+	b, err := ioutil.ReadAll(conn2)
+	utest.IsNilNow(t, err)
+	utest.EqualNow(t, string(b), "\x02\x16502 connection refused")
+}
+
+func Test_CodeWriteTimeout(t *testing.T) {
+	oldCodeWrite := cfgCodeWrite
+	cfgCodeWrite = uint(50 * time.Millisecond)
+	defer func() {
+		cfgCodeWrite = oldCodeWrite
+	}()
+
+	// a pipe has no buffer, the write waits for a reader which never comes
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	start := time.Now()
+	err := writeCode(c1, codeBadReq)
+	utest.NotNilNow(t, err)
+	ne, ok := err.(net.Error)
+	utest.Assert(t, ok && ne.Timeout())
+	utest.Assert(t, time.Since(start) < time.Second)
+
+	// the deadline is cleared afterwards
+	go ioutil.ReadAll(c2)
+	time.Sleep(100 * time.Millisecond)
+	utest.IsNilNow(t, writeCode(c1, codeOK))
+}
+
+func Test_TenantSecrets(t *testing.T) {
+	cfgTenants = "alpha=secret-a, beta=secret-b"
+	utest.IsNilNow(t, setupTenants())
+	defer func() {
+		cfgTenants = ""
+		setupTenants()
+	}()
+
+	listener := testEchoServer(t)
+	defer listener.Close()
+
+	handshake := func(line string) (net.Conn, string) {
+		conn, err := net.Dial("tcp", cfgGatewayAddr)
+		utest.IsNilNow(t, err)
+		_, err = conn.Write([]byte(line + "\n"))
+		utest.IsNilNow(t, err)
+		code := make([]byte, 3)
+		io.ReadFull(conn, code)
+		return conn, string(code)
+	}
+	encrypt := func(secret string) string {
+		encryptedAddr, err := aes256cbc.EncryptString(secret, listener.Addr().String())
+		utest.IsNilNow(t, err)
+		return encryptedAddr
+	}
+
+	conn, code := handshake("alpha:" + encrypt("secret-a"))
+	defer conn.Close()
+	utest.EqualNow(t, code, string(codeOK))
+	testEcho(t, conn, 1)
+
+	// the secret of another tenant, or the gateway's, doesn't do
+	conn2, code := handshake("beta:" + encrypt("secret-a"))
+	conn2.Close()
+	utest.EqualNow(t, code, string(codeBadAddr))
+	conn3, code := handshake("alpha:" + encrypt(string(cfgSecret)))
+	conn3.Close()
+	utest.EqualNow(t, code, string(codeBadAddr))
+	conn4, code := handshake("gamma:" + encrypt("secret-a"))
+	conn4.Close()
+	utest.EqualNow(t, code, string(codeBadAddr))
+
+	// lines without a tenant still use the gateway's passphrase
+	conn5 := testTunnel(t, listener.Addr().String())
+	defer conn5.Close()
+	testEcho(t, conn5, 1)
+
+	cfgTenants = "alpha"
+	utest.NotNilNow(t, setupTenants())
+}
+
+func Test_LogFailures(t *testing.T) {
+	cfgLogFailures = true
+	defer func() {
+		cfgLogFailures = false
+	}()
+	failureSummary()
+
+	for i := 0; i < 3; i++ {
+		conn, err := net.Dial("tcp", cfgGatewayAddr)
+		utest.IsNilNow(t, err)
+		_, err = conn.Write([]byte("not a secret\n"))
+		utest.IsNilNow(t, err)
+		b, err := ioutil.ReadAll(conn)
+		utest.IsNilNow(t, err)
+		utest.EqualNow(t, string(b), string(codeBadAddr))
+		conn.Close()
+	}
+	total, ips := failureSummary()
+	utest.EqualNow(t, total, 3)
+	utest.EqualNow(t, ips, 1)
+
+	// only the first failure of an IP in an interval is logged
+	s := &session{client: &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 1000}}
+	utest.Assert(t, logFailure(s, "bad request"))
+	utest.Assert(t, !logFailure(s, "bad request"))
+	s2 := &session{client: &net.TCPAddr{IP: net.ParseIP("192.0.2.2"), Port: 1000}}
+	utest.Assert(t, logFailure(s2, "decrypt failed"))
+	total, ips = failureSummary()
+	utest.EqualNow(t, total, 3)
+	utest.EqualNow(t, ips, 2)
+	utest.Assert(t, logFailure(s, "bad request"))
+	failureSummary()
+}
+
+func Test_HandshakeMinRate(t *testing.T) {
+	cfgMinRate = 100
+	defer func() {
+		cfgMinRate = 0
+	}()
+
+	listener := testEchoServer(t)
+	defer listener.Close()
+
+	// a byte every 200ms falls below 100 bytes per second after a second
+	conn, err := net.Dial("tcp", cfgGatewayAddr)
+	utest.IsNilNow(t, err)
+	defer conn.Close()
+	start := time.Now()
+	go func() {
+		for i := 0; i < 20; i++ {
+			if _, err := conn.Write([]byte("U")); err != nil {
+				return
+			}
+			time.Sleep(200 * time.Millisecond)
+		}
+	}()
+	conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	b, err := ioutil.ReadAll(conn)
+	utest.IsNilNow(t, err)
+	utest.EqualNow(t, string(b), string(codeBadReq))
+	utest.Assert(t, time.Since(start) < 2*time.Second)
+
+	// a client sending at once is not affected
+	conn2 := testTunnel(t, listener.Addr().String())
+	defer conn2.Close()
+	time.Sleep(1500 * time.Millisecond)
+	testEcho(t, conn2, 1)
+}
+
+// testSOCKSServer is a SOCKS5 proxy with username/password and CONNECT to
+// IPv4 addresses, enough for the upstream of the gateway.
+func testSOCKSServer(t *testing.T, user, password string) net.Listener {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	utest.IsNilNow(t, err)
+	serve := func(conn net.Conn) {
+		defer conn.Close()
+		buf := make([]byte, 512)
+		if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+			return
+		}
+		if _, err := io.ReadFull(conn, buf[:buf[1]]); err != nil {
+			return
+		}
+		conn.Write([]byte{5, 2})
+		if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+			return
+		}
+		u := make([]byte, buf[1])
+		if _, err := io.ReadFull(conn, u); err != nil {
+			return
+		}
+		if _, err := io.ReadFull(conn, buf[:1]); err != nil {
+			return
+		}
+		p := make([]byte, buf[0])
+		if _, err := io.ReadFull(conn, p); err != nil {
+			return
+		}
+		if string(u) != user || string(p) != password {
+			conn.Write([]byte{1, 1})
+			return
+		}
+		conn.Write([]byte{1, 0})
+		if _, err := io.ReadFull(conn, buf[:4+4+2]); err != nil || buf[3] != 1 {
+			return
+		}
+		addr := net.JoinHostPort(net.IP(buf[4:8]).String(), strconv.Itoa(int(binary.BigEndian.Uint16(buf[8:10]))))
+		target, err := net.Dial("tcp", addr)
+		if err != nil {
+			conn.Write([]byte{5, 5, 0, 1, 0, 0, 0, 0, 0, 0})
+			return
+		}
+		defer target.Close()
+		conn.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+		go io.Copy(target, conn)
+		io.Copy(conn, target)
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go serve(conn)
+		}
+	}()
+	return listener
+}
+
+func Test_UpstreamSOCKS(t *testing.T) {
+	listener := testEchoServer(t)
+	defer listener.Close()
+
+	proxy := testSOCKSServer(t, "user", "pass")
+	defer proxy.Close()
+	cfgUpSOCKS = "user:pass@" + proxy.Addr().String()
+	defer func() {
+		cfgUpSOCKS = ""
+	}()
+	conn := testTunnel(t, listener.Addr().String())
+	defer conn.Close()
+	testEcho(t, conn, 10)
+
+	// the connection list shows the target server, not the proxy
+	w := httptest.NewRecorder()
+	connectionsHandler(w, httptest.NewRequest("GET", "/connections", nil))
+	var list []sessionInfo
+	utest.IsNilNow(t, json.Unmarshal(w.Body.Bytes(), &list))
+	var found bool
+	for _, info := range list {
+		utest.Assert(t, info.Target != proxy.Addr().String())
+		found = found || info.Target == listener.Addr().String()
+	}
+	utest.Assert(t, found)
+
+	// a refused dial of the upstream proxy is a refused dial
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	utest.IsNilNow(t, err)
+	addr := closed.Addr().String()
+	closed.Close()
+	conn2, err := net.Dial("tcp", cfgGatewayAddr)
+	utest.IsNilNow(t, err)
+	defer conn2.Close()
+	encryptedAddr, err := aes256cbc.EncryptString(string(cfgSecret), addr)
+	utest.IsNilNow(t, err)
+	_, err = conn2.Write(append([]byte{versionFlag | 2}, encryptedAddr+"\n"...))
+	utest.IsNilNow(t, err)
+	b, err := ioutil.ReadAll(conn2)
+	utest.IsNilNow(t, err)
+	utest.EqualNow(t, string(b), "\x02\x16502 connection refused")
+
+	cfgUpSOCKS = "user:wrong@" + proxy.Addr().String()
+	conn3, err := net.Dial("tcp", cfgGatewayAddr)
+	utest.IsNilNow(t, err)
+	defer conn3.Close()
+	encryptedAddr, err = aes256cbc.EncryptString(string(cfgSecret), listener.Addr().String())
+	utest.IsNilNow(t, err)
+	_, err = conn3.Write([]byte(encryptedAddr + "\n"))
+	utest.IsNilNow(t, err)
+	b, err = ioutil.ReadAll(conn3)
+	utest.IsNilNow(t, err)
+	utest.EqualNow(t, string(b), string(codeDialErr))
+
+	// lengths which don't fit in a byte of the SOCKS messages
+	long := strings.Repeat("x", 256)
+	utest.IsNilNow(t, checkUpstream())
+	cfgUpSOCKS = "user:" + long + "@" + proxy.Addr().String()
+	utest.EqualNow(t, checkUpstream(), errUpstreamCred)
+	cfgUpSOCKS = "user:pass@" + proxy.Addr().String()
+	_, err = dialUpstream(context.Background(), &net.Dialer{}, long+":80")
+	utest.EqualNow(t, err, errUpstreamHost)
+}
+
+func Test_SOCKS(t *testing.T) {
+	cfgSOCKS = true
+	defer func() {
+		cfgSOCKS = false
+	}()
+
+	connect := func(password string, addr string) (net.Conn, []byte) {
+		conn, err := net.Dial("tcp", cfgGatewayAddr)
+		utest.IsNilNow(t, err)
+		_, err = conn.Write([]byte{5, 2, 0, 2})
+		utest.IsNilNow(t, err)
+		reply := make([]byte, 2)
+		_, err = io.ReadFull(conn, reply)
+		utest.IsNilNow(t, err)
+		utest.EqualNow(t, reply, []byte{5, 2})
+
+		auth := append([]byte{1, 4}, "user"...)
+		auth = append(append(auth, byte(len(password))), password...)
+		_, err = conn.Write(auth)
+		utest.IsNilNow(t, err)
+		_, err = io.ReadFull(conn, reply)
+		utest.IsNilNow(t, err)
+		if reply[1] != 0 {
+			return conn, reply
+		}
+
+		host, port, err := net.SplitHostPort(addr)
+		utest.IsNilNow(t, err)
+		p, err := strconv.Atoi(port)
+		utest.IsNilNow(t, err)
+		req := append([]byte{5, 1, 0, 1}, net.ParseIP(host).To4()...)
+		req = append(req, byte(p>>8), byte(p))
+		_, err = conn.Write(req)
+		utest.IsNilNow(t, err)
+		reply = make([]byte, 10)
+		_, err = io.ReadFull(conn, reply)
+		utest.IsNilNow(t, err)
+		return conn, reply
+	}
+
+	listener := testEchoServer(t)
+	defer listener.Close()
+
+	conn, reply := connect(string(cfgSecret), listener.Addr().String())
+	defer conn.Close()
+	utest.EqualNow(t, reply, []byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+	testEcho(t, conn, 10)
+
+	// wrong password
+	conn2, reply := connect("wrong", listener.Addr().String())
+	defer conn2.Close()
+	utest.EqualNow(t, reply, []byte{1, 1})
+	_, err := ioutil.ReadAll(conn2)
+	utest.IsNilNow(t, err)
+
+	// target server refused
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	utest.IsNilNow(t, err)
+	addr := closed.Addr().String()
+	closed.Close()
+	conn3, reply := connect(string(cfgSecret), addr)
+	defer conn3.Close()
+	utest.EqualNow(t, reply[:2], []byte{5, socksRefused})
+
+	// the encrypted handshake still works
+	conn4 := testTunnel(t, listener.Addr().String())
+	defer conn4.Close()
+	testEcho(t, conn4, 1)
+
+	// greeting, password, request and data all in one write, the data
+	// still reaches target server
+	host, port, err := net.SplitHostPort(listener.Addr().String())
+	utest.IsNilNow(t, err)
+	p, err := strconv.Atoi(port)
+	utest.IsNilNow(t, err)
+	msg := []byte{5, 1, 2}
+	msg = append(append(msg, 1, 4), "user"...)
+	msg = append(append(msg, byte(len(cfgSecret))), cfgSecret...)
+	msg = append(append(msg, 5, 1, 0, 1), net.ParseIP(host).To4()...)
+	msg = append(msg, byte(p>>8), byte(p))
+	msg = append(msg, "pipelined"...)
+	conn6, err := net.Dial("tcp", cfgGatewayAddr)
+	utest.IsNilNow(t, err)
+	defer conn6.Close()
+	_, err = conn6.Write(msg)
+	utest.IsNilNow(t, err)
+	reply = make([]byte, 2+2+10+len("pipelined"))
+	_, err = io.ReadFull(conn6, reply)
+	utest.IsNilNow(t, err)
+	utest.EqualNow(t, reply[:14], []byte{5, 2, 1, 0, 5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+	utest.EqualNow(t, string(reply[14:]), "pipelined")
+
+	// a request of another version, and a domain name which would be a
+	// list of targets
+	request := func(req []byte) []byte {
+		conn, err := net.Dial("tcp", cfgGatewayAddr)
+		utest.IsNilNow(t, err)
+		defer conn.Close()
+		msg := []byte{5, 1, 2}
+		msg = append(append(msg, 1, 4), "user"...)
+		msg = append(append(msg, byte(len(cfgSecret))), cfgSecret...)
+		_, err = conn.Write(append(msg, req...))
+		utest.IsNilNow(t, err)
+		reply, err := ioutil.ReadAll(conn)
+		utest.IsNilNow(t, err)
+		utest.EqualNow(t, len(reply), 2+2+10)
+		return reply[4:6]
+	}
+	bad := append([]byte{4, 1, 0, 1}, net.ParseIP(host).To4()...)
+	utest.EqualNow(t, request(append(bad, byte(p>>8), byte(p))), []byte{5, socksFailure})
+	name := "localhost," + listener.Addr().String()
+	bad = append([]byte{5, 1, 0, 3, byte(len(name))}, name...)
+	utest.EqualNow(t, request(append(bad, byte(p>>8), byte(p))), []byte{5, socksUnreachable})
+
+	// with only -tenant-secrets there is no secret, an empty password is
+	// not it
+	passphrase.Store([]byte{})
+	defer passphrase.Store(cfgSecret)
+	conn5, reply := connect("", listener.Addr().String())
+	defer conn5.Close()
+	utest.EqualNow(t, reply, []byte{1, 1})
+}
+
+func Test_BlockSelf(t *testing.T) {
+	cfgBlockSelf = true
+	defer func() {
+		cfgBlockSelf = false
+	}()
+
+	response := func(target string) string {
+		conn, err := net.Dial("tcp", cfgGatewayAddr)
+		utest.IsNilNow(t, err)
+		defer conn.Close()
+		encryptedAddr, err := aes256cbc.EncryptString(string(cfgSecret), target)
+		utest.IsNilNow(t, err)
+		_, err = conn.Write([]byte(encryptedAddr + "\n"))
+		utest.IsNilNow(t, err)
+		b, err := ioutil.ReadAll(conn)
+		utest.IsNilNow(t, err)
+		return string(b)
+	}
+
+	_, port, err := net.SplitHostPort(cfgGatewayAddr)
+	utest.IsNilNow(t, err)
+	utest.EqualNow(t, response(cfgGatewayAddr), "508")
+	utest.EqualNow(t, response("localhost:"+port), "508")
+	utest.EqualNow(t, response("[::1]:"+port), "508")
+	utest.EqualNow(t, response("0.0.0.0:"+port), "508")
+
+	utest.Assert(t, localIP(nil, net.ParseIP("::ffff:127.0.0.1")))
+	utest.Assert(t, !localIP(nil, net.ParseIP("10.1.2.3")))
+	utest.Assert(t, localIP([]net.Addr{&net.IPNet{IP: net.ParseIP("10.1.2.3"), Mask: net.CIDRMask(8, 32)}}, net.ParseIP("10.1.2.3")))
+
+	// only names on a port of the gateway are resolved, to the IPs which
+	// are dialed then
+	targets, err := checkSelf(context.Background(), []string{"localhost:1", "unix:/tmp/app.sock", "10.1.2.3:" + port})
+	utest.IsNilNow(t, err)
+	utest.EqualNow(t, targets, []string{"localhost:1", "unix:/tmp/app.sock", "10.1.2.3:" + port})
+	ips, err := lookupHost(context.Background(), "localhost")
+	utest.IsNilNow(t, err)
+	utest.Assert(t, len(ips) > 0)
+	for _, ip := range ips {
+		utest.Assert(t, ip.IsLoopback())
+		utest.Assert(t, ip.To4() == nil || len(ip) == net.IPv4len)
+	}
+
+	listener := testEchoServer(t)
+	defer listener.Close()
+	conn := testTunnel(t, listener.Addr().String())
+	defer conn.Close()
+	testEcho(t, conn, 1)
+}
+
+func Test_UDP(t *testing.T) {
+	cfgUDP = true
+	defer func() {
+		cfgUDP = false
+	}()
+
+	// UDP echo server
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	utest.IsNilNow(t, err)
+	defer pc.Close()
+	go func() {
+		buf := make([]byte, udpMaxPacket)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			pc.WriteTo(buf[:n], addr)
+		}
+	}()
+
+	conn, err := net.Dial("tcp", cfgGatewayAddr)
+	utest.IsNilNow(t, err)
+	defer conn.Close()
+
+	frame := func(p []byte) []byte {
+		b := make([]byte, 2, 2+len(p))
+		binary.BigEndian.PutUint16(b, uint16(len(p)))
+		return append(b, p...)
+	}
+
+	// the first datagram is sent along with the handshake
+	encryptedAddr, err := aes256cbc.EncryptString(string(cfgSecret), "udp://"+pc.LocalAddr().String())
+	utest.IsNilNow(t, err)
+	_, err = conn.Write(append([]byte(encryptedAddr+"\n"), frame([]byte("first"))...))
+	utest.IsNilNow(t, err)
+
+	code := make([]byte, 3)
+	_, err = io.ReadFull(conn, code)
+	utest.IsNilNow(t, err)
+	utest.EqualNow(t, string(code), string(codeOK))
+
+	for i := 0; i < 100; i++ {
+		b1 := RandBytes(1024)
+		if i == 0 {
+			b1 = []byte("first")
+		} else {
+			_, err = conn.Write(frame(b1))
+			utest.IsNilNow(t, err)
+		}
+		b2 := make([]byte, 2+len(b1))
+		_, err = io.ReadFull(conn, b2)
+		utest.IsNilNow(t, err)
+		utest.EqualNow(t, int(binary.BigEndian.Uint16(b2)), len(b1))
+		utest.EqualNow(t, b2[2:], b1)
+	}
+}
+
+func testStats(t *testing.T) stats {
+	w := httptest.NewRecorder()
+	statsHandler(w, httptest.NewRequest("GET", "/stats", nil))
+	var st stats
+	utest.IsNilNow(t, json.Unmarshal(w.Body.Bytes(), &st))
+	return st
+}
+
+func Test_Stats(t *testing.T) {
+	listener := testEchoServer(t)
+	defer listener.Close()
+
+	before := testStats(t)
+	conn := testTunnel(t, listener.Addr().String())
+	defer conn.Close()
+	testEcho(t, conn, 10)
+	after := testStats(t)
+
+	utest.Assert(t, after.ActiveConnections >= 1)
+	utest.Assert(t, after.TotalConnections > before.TotalConnections)
+	utest.Assert(t, after.UploadBytes > before.UploadBytes)
+	utest.Assert(t, after.DownloadBytes > before.DownloadBytes)
+}
+
+func benchmarkRelay(b *testing.B, poll bool) {
+	cfgPoll = poll
+	defer func() {
+		cfgPoll = false
+	}()
+
+	listener := testEchoServer(b)
+	defer listener.Close()
+
+	conn := testTunnel(b, listener.Addr().String())
+	defer conn.Close()
+
+	b.ResetTimer()
+	testEcho(b, conn, b.N)
+}
+
+func Benchmark_Relay(b *testing.B) {
+	benchmarkRelay(b, false)
+}
+
+func Benchmark_RelayPoll(b *testing.B) {
+	benchmarkRelay(b, true)
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+)
+
+var (
+	maintenance     int32
+	maintenanceNets []*net.IPNet
+)
+
+func init() {
+	http.HandleFunc("/maintenance", maintenanceHandler)
+}
+
+func setupMaintenance() (err error) {
+	if cfgMaintenance {
+		atomic.StoreInt32(&maintenance, 1)
+	}
+	maintenanceNets, err = parseCIDRs(cfgMaintAllow)
+	return
+}
+
+func inMaintenance() bool {
+	return atomic.LoadInt32(&maintenance) == 1
+}
+
+func setMaintenance(on bool) {
+	if on {
+		atomic.StoreInt32(&maintenance, 1)
+	} else {
+		atomic.StoreInt32(&maintenance, 0)
+	}
+}
+
+// maintenanceAllow reports whether a new connection can go on. Clients in the
+// -maintenance-allow list bypass maintenance mode, so health checkers and
+// admins can still reach the backends while the gateway is drained.
+func maintenanceAllow(client net.Addr) bool {
+	if !inMaintenance() {
+		return true
+	}
+	if ip, err := addrIP(client); err == nil && containsIP(maintenanceNets, ip) {
+		printf("Maintenance bypass: %s", client)
+		return true
+	}
+	return false
+}
+
+// maintenanceHandler shows the maintenance mode on GET and switches it on POST,
+// e.g. "curl -X POST 'http://pprof-addr/maintenance?on=true'". Like closing a
+// connection, switching is refused unless adminTrusted.
+func maintenanceHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "POST" {
+		params := map[string]string{"on": r.FormValue("on")}
+		on, err := strconv.ParseBool(r.FormValue("on"))
+		if err != nil {
+			auditf(r.RemoteAddr, "maintenance", params, "bad value of 'on'")
+			http.Error(w, "bad value of 'on'", http.StatusBadRequest)
+			return
+		}
+		if !adminTrusted() {
+			auditf(r.RemoteAddr, "maintenance", params, "admin address not trusted")
+			http.Error(w, "admin address not trusted", http.StatusForbidden)
+			return
+		}
+		setMaintenance(on)
+		auditf(r.RemoteAddr, "maintenance", params, "ok")
+		printf("Maintenance mode: %v", on)
+	}
+	fmt.Fprintf(w, "%v\n", inMaintenance())
+}
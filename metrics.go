@@ -0,0 +1,147 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// Prometheus text exposition of the gateway counters, written by hand since
+// a handful of counters and one histogram don't need a client library.
+
+var (
+	// failed handshakes by the code sent to client, the map itself is never
+	// written after init so only the counters need to be atomic
+	handshakeFailures = map[string]*uint64{}
+
+	dialBuckets  = []float64{.001, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+	dialCounts   = make([]uint64, len(dialBuckets)+1) // the last one is +Inf
+	dialSumNanos uint64
+
+	recoveredPanics uint64
+
+	decryptCount    uint64
+	decryptSumNanos uint64
+
+	closeCounts = make([]uint64, len(closeReasons))
+)
+
+// why a relayed connection ended, see session.closedBy()
+const (
+	closeUnknown int32 = iota
+	closeClientEOF
+	closeBackendEOF
+	closeIdle
+	closeByteCap
+	closeDurationCap
+	closeError
+)
+
+var closeReasons = []string{"unknown", "client_eof", "backend_eof", "idle_timeout", "byte_cap", "duration_cap", "error"}
+
+func init() {
+	for _, code := range [][]byte{codeBadReq, codeBadAddr, codeForbidden, codeDialErr, codeUnavailable, codeDialTimeout, codeInternal, codeSelfLoop} {
+		handshakeFailures[string(code)] = new(uint64)
+	}
+	http.HandleFunc("/metrics", metricsHandler)
+}
+
+func countHandshakeFailure(code []byte) {
+	if n, ok := handshakeFailures[string(code)]; ok {
+		atomic.AddUint64(n, 1)
+	}
+}
+
+func countPanic() {
+	atomic.AddUint64(&recoveredPanics, 1)
+}
+
+// countClose counts a relayed connection by the reason it ended, one which
+// ended without any, like after a panic, counts as an error.
+func countClose(s *session) {
+	reason := atomic.LoadInt32(&s.closeBy)
+	if reason == closeUnknown {
+		reason = closeError
+	}
+	atomic.AddUint64(&closeCounts[reason], 1)
+}
+
+func observeDecrypt(d time.Duration) {
+	atomic.AddUint64(&decryptCount, 1)
+	atomic.AddUint64(&decryptSumNanos, uint64(d))
+}
+
+func observeDial(d time.Duration) {
+	i := sort.SearchFloat64s(dialBuckets, d.Seconds())
+	atomic.AddUint64(&dialCounts[i], 1)
+	atomic.AddUint64(&dialSumNanos, uint64(d))
+}
+
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	fmt.Fprintf(w, "# HELP gateway_connections_total Connections accepted since start.\n")
+	fmt.Fprintf(w, "# TYPE gateway_connections_total counter\n")
+	fmt.Fprintf(w, "gateway_connections_total %d\n", atomic.LoadUint64(&totalConns))
+
+	fmt.Fprintf(w, "# HELP gateway_active_connections Connections accepted and not closed yet.\n")
+	fmt.Fprintf(w, "# TYPE gateway_active_connections gauge\n")
+	fmt.Fprintf(w, "gateway_active_connections %d\n", atomic.LoadInt64(&activeConns))
+
+	fmt.Fprintf(w, "# HELP gateway_handshake_failures_total Handshakes rejected, by the code sent to client.\n")
+	fmt.Fprintf(w, "# TYPE gateway_handshake_failures_total counter\n")
+	codes := make([]string, 0, len(handshakeFailures))
+	for code := range handshakeFailures {
+		codes = append(codes, code)
+	}
+	sort.Strings(codes)
+	for _, code := range codes {
+		fmt.Fprintf(w, "gateway_handshake_failures_total{code=%q} %d\n", code, atomic.LoadUint64(handshakeFailures[code]))
+	}
+
+	fmt.Fprintf(w, "# HELP gateway_recovered_panics_total Panics recovered in connection goroutines.\n")
+	fmt.Fprintf(w, "# TYPE gateway_recovered_panics_total counter\n")
+	fmt.Fprintf(w, "gateway_recovered_panics_total %d\n", atomic.LoadUint64(&recoveredPanics))
+
+	fmt.Fprintf(w, "# HELP gateway_connection_close_total Relayed connections ended, by the first reason.\n")
+	fmt.Fprintf(w, "# TYPE gateway_connection_close_total counter\n")
+	for reason, name := range closeReasons {
+		if reason != int(closeUnknown) {
+			fmt.Fprintf(w, "gateway_connection_close_total{reason=%q} %d\n", name, atomic.LoadUint64(&closeCounts[reason]))
+		}
+	}
+
+	fmt.Fprintf(w, "# HELP gateway_dial_duration_seconds Time to connect to target server, for each attempt.\n")
+	fmt.Fprintf(w, "# TYPE gateway_dial_duration_seconds histogram\n")
+	var count uint64
+	for i, le := range dialBuckets {
+		count += atomic.LoadUint64(&dialCounts[i])
+		fmt.Fprintf(w, "gateway_dial_duration_seconds_bucket{le=\"%g\"} %d\n", le, count)
+	}
+	count += atomic.LoadUint64(&dialCounts[len(dialBuckets)])
+	fmt.Fprintf(w, "gateway_dial_duration_seconds_bucket{le=\"+Inf\"} %d\n", count)
+	fmt.Fprintf(w, "gateway_dial_duration_seconds_sum %g\n", time.Duration(atomic.LoadUint64(&dialSumNanos)).Seconds())
+	fmt.Fprintf(w, "gateway_dial_duration_seconds_count %d\n", count)
+
+	fmt.Fprintf(w, "# HELP gateway_decrypt_duration_seconds Time to decrypt target server addresses of handshakes.\n")
+	fmt.Fprintf(w, "# TYPE gateway_decrypt_duration_seconds summary\n")
+	fmt.Fprintf(w, "gateway_decrypt_duration_seconds_sum %g\n", time.Duration(atomic.LoadUint64(&decryptSumNanos)).Seconds())
+	fmt.Fprintf(w, "gateway_decrypt_duration_seconds_count %d\n", atomic.LoadUint64(&decryptCount))
+
+	fmt.Fprintf(w, "# HELP gateway_geoip_total Connections checked by -geoip, by the country of client.\n")
+	fmt.Fprintf(w, "# TYPE gateway_geoip_total counter\n")
+	geoipAccept.Do(func(kv expvar.KeyValue) {
+		fmt.Fprintf(w, "gateway_geoip_total{country=%q,result=\"accept\"} %s\n", kv.Key, kv.Value)
+	})
+	geoipReject.Do(func(kv expvar.KeyValue) {
+		fmt.Fprintf(w, "gateway_geoip_total{country=%q,result=\"reject\"} %s\n", kv.Key, kv.Value)
+	})
+
+	fmt.Fprintf(w, "# HELP gateway_bytes_total Bytes relayed since start.\n")
+	fmt.Fprintf(w, "# TYPE gateway_bytes_total counter\n")
+	fmt.Fprintf(w, "gateway_bytes_total{direction=\"upload\"} %d\n", atomic.LoadUint64(&totalUpload))
+	fmt.Fprintf(w, "gateway_bytes_total{direction=\"download\"} %d\n", atomic.LoadUint64(&totalDownload))
+}
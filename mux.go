@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"net"
+	"sync"
+
+	"github.com/hashicorp/yamux"
+)
+
+// Shared yamux sessions by target server address. Each client gets a stream,
+// the stream carries exactly the bytes a dedicated connection would carry, so
+// opening a stream is the equivalent of a dial.
+var muxSessions = struct {
+	sync.Mutex
+	m       map[string][]*yamux.Session
+	dialing map[string]chan struct{} // closed when the dial of a new session ends
+}{
+	m:       make(map[string][]*yamux.Session),
+	dialing: make(map[string]chan struct{}),
+}
+
+func dialMux(ctx context.Context, addr string) (net.Conn, error) {
+	session, err := muxSession(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+	stream, err := session.Open()
+	if err != nil {
+		// the next dialMux() will replace this session
+		session.Close()
+		return nil, err
+	}
+	return stream, nil
+}
+
+// muxSession returns the least busy session to the target server. A new one
+// is dialed when there are less than -mux-conns alive. Only one session of an
+// address is dialed at a time, so concurrent first clients don't dial more
+// than -mux-conns of them; they wait for it unless a session is alive.
+func muxSession(ctx context.Context, addr string) (*yamux.Session, error) {
+	for {
+		muxSessions.Lock()
+		var alive []*yamux.Session
+		var best *yamux.Session
+		for _, session := range muxSessions.m[addr] {
+			if session.IsClosed() {
+				continue
+			}
+			alive = append(alive, session)
+			if best == nil || session.NumStreams() < best.NumStreams() {
+				best = session
+			}
+		}
+		muxSessions.m[addr] = alive
+		if uint(len(alive)) >= cfgMuxConns && best != nil {
+			muxSessions.Unlock()
+			return best, nil
+		}
+		if dialing := muxSessions.dialing[addr]; dialing != nil {
+			muxSessions.Unlock()
+			if best != nil {
+				return best, nil
+			}
+			select {
+			case <-dialing:
+				continue
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		}
+		dialing := make(chan struct{})
+		muxSessions.dialing[addr] = dialing
+		muxSessions.Unlock()
+
+		session, err := muxDial(ctx, addr)
+
+		muxSessions.Lock()
+		if err == nil {
+			muxSessions.m[addr] = append(muxSessions.m[addr], session)
+		}
+		delete(muxSessions.dialing, addr)
+		muxSessions.Unlock()
+		close(dialing)
+		return session, err
+	}
+}
+
+func muxDial(ctx context.Context, addr string) (*yamux.Session, error) {
+	conn, err := dial(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+	session, err := yamux.Client(conn, nil)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return session, nil
+}
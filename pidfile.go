@@ -0,0 +1,40 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// writePidFile records pid in -pid-file. A file left by a gateway which is
+// still running is an error, one left by a crashed gateway is replaced. The
+// file is written aside and renamed, so it's never seen half written.
+func writePidFile(path string, pid int) error {
+	if data, err := ioutil.ReadFile(path); err == nil {
+		old, err := strconv.Atoi(string(bytes.TrimSpace(data)))
+		if err == nil && old != pid && pidAlive(old) {
+			return fmt.Errorf("gateway is running as process %d", old)
+		}
+	}
+	file, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	_, err = file.WriteString(strconv.Itoa(pid))
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(file.Name(), 0644)
+	}
+	if err == nil {
+		err = os.Rename(file.Name(), path)
+	}
+	if err != nil {
+		os.Remove(file.Name())
+	}
+	return err
+}
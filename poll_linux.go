@@ -0,0 +1,270 @@
+// +build linux
+
+package main
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"syscall"
+)
+
+// In -poll mode both directions of a tunnel are copied by one shared epoll
+// goroutine, the connection's own goroutine only waits for the end. The
+// poller works on dup()ed fds, so a fd number is never reused under it.
+// Like copy() each side only passes its EOF on to the other side, the relay
+// ends once both sides sent EOF or on the first error.
+
+type pollSide struct {
+	fd    int
+	peer  *pollSide
+	n     *uint64 // bytes copied from this side to peer
+	total *uint64
+	s     *session
+	eof   int32 // close reason when this side sent EOF
+	done  bool  // this side sent EOF, it is not read any more
+
+	buf        []byte
+	start, end int // data read from this side and not written to peer yet
+}
+
+type pollPair struct {
+	a, b pollSide
+	done chan struct{}
+}
+
+var poller struct {
+	once sync.Once
+	err  error
+	epfd int
+
+	sync.Mutex
+	sides map[int]*pollSide
+	pairs map[*pollSide]*pollPair
+}
+
+// pollRelay copies data between s.conn and s.agent until both sides sent EOF
+// or one failed, or the session is cancelled. It returns false when the
+// connections don't support -poll mode.
+func pollRelay(s *session, pool *sync.Pool) bool {
+	poller.once.Do(startPoller)
+	if poller.err != nil {
+		return false
+	}
+
+	connFd, err := dupFd(s.conn)
+	if err != nil {
+		return false
+	}
+	agentFd, err := dupFd(s.agent)
+	if err != nil {
+		syscall.Close(connFd)
+		return false
+	}
+
+	b1, b2 := pool.Get().(*[]byte), pool.Get().(*[]byte)
+	defer pool.Put(b1)
+	defer pool.Put(b2)
+
+	p := &pollPair{done: make(chan struct{})}
+	p.a = pollSide{fd: connFd, peer: &p.b, n: &s.upload, total: &totalUpload, s: s, eof: closeClientEOF, buf: *b1}
+	p.b = pollSide{fd: agentFd, peer: &p.a, n: &s.download, total: &totalDownload, s: s, eof: closeBackendEOF, buf: *b2}
+
+	// the fds are added without interest first, nothing is read before both
+	// are in, so the relay can still go back to copy() when one can't be
+	var ev syscall.EpollEvent
+	ev.Fd = int32(connFd)
+	err = syscall.EpollCtl(poller.epfd, syscall.EPOLL_CTL_ADD, connFd, &ev)
+	if err == nil {
+		ev.Fd = int32(agentFd)
+		if err = syscall.EpollCtl(poller.epfd, syscall.EPOLL_CTL_ADD, agentFd, &ev); err != nil {
+			syscall.EpollCtl(poller.epfd, syscall.EPOLL_CTL_DEL, connFd, nil)
+		}
+	}
+	if err != nil {
+		syscall.Close(connFd)
+		syscall.Close(agentFd)
+		return false
+	}
+
+	poller.Lock()
+	poller.sides[connFd] = &p.a
+	poller.sides[agentFd] = &p.b
+	poller.pairs[&p.a] = p
+	poller.pairs[&p.b] = p
+	pollWatch(&p.a)
+	pollWatch(&p.b)
+	poller.Unlock()
+
+	// closing s.conn and s.agent doesn't close the dup()ed fds, shut down the
+	// sockets when the session is cancelled
+	select {
+	case <-p.done:
+	case <-s.ctx.Done():
+		pollShutdown(p)
+		<-p.done
+	}
+	return true
+}
+
+// pollShutdown shuts down both sockets of a pair, the poller sees the end
+// and closes the pair. The fds are still open while the pair is registered.
+func pollShutdown(p *pollPair) {
+	poller.Lock()
+	defer poller.Unlock()
+	if poller.pairs[&p.a] == nil {
+		return
+	}
+	syscall.Shutdown(p.a.fd, syscall.SHUT_RDWR)
+	syscall.Shutdown(p.b.fd, syscall.SHUT_RDWR)
+}
+
+func dupFd(conn net.Conn) (int, error) {
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return -1, syscall.EINVAL
+	}
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		return -1, err
+	}
+	fd, derr := -1, error(nil)
+	if err := rc.Control(func(sysfd uintptr) {
+		fd, derr = syscall.Dup(int(sysfd))
+	}); err != nil {
+		return -1, err
+	}
+	return fd, derr
+}
+
+func startPoller() {
+	poller.epfd, poller.err = syscall.EpollCreate1(syscall.EPOLL_CLOEXEC)
+	if poller.err != nil {
+		printf("Setup poller failed: %s", poller.err)
+		return
+	}
+	poller.sides = make(map[int]*pollSide)
+	poller.pairs = make(map[*pollSide]*pollPair)
+	go pollLoop()
+}
+
+func pollLoop() {
+	events := make([]syscall.EpollEvent, 128)
+	for {
+		n, err := syscall.EpollWait(poller.epfd, events, -1)
+		if err != nil {
+			if err == syscall.EINTR {
+				continue
+			}
+			fatalf("Poller failed: %s", err)
+		}
+		for i := 0; i < n; i++ {
+			poller.Lock()
+			side := poller.sides[int(events[i].Fd)]
+			p := poller.pairs[side]
+			poller.Unlock()
+			if side == nil {
+				continue
+			}
+			if !pollEvent(side, events[i].Events) {
+				pollClose(p)
+			}
+		}
+	}
+}
+
+// pollEvent handles an event of side's fd, returns false when the relay ends.
+func pollEvent(side *pollSide, events uint32) bool {
+	// hang up is reported regardless of interest, data pending can't wait
+	// and a side which sent EOF already has nothing more to give
+	if events&(syscall.EPOLLHUP|syscall.EPOLLERR) != 0 && (side.start < side.end || side.done) {
+		return false
+	}
+
+	// flush data of peer which waited for side to be writable
+	if events&(syscall.EPOLLOUT|syscall.EPOLLERR) != 0 && side.peer.start < side.peer.end {
+		if !pollFlush(side.peer) {
+			return false
+		}
+	}
+
+	// read only when data read last time all went to peer
+	if events&(syscall.EPOLLIN|syscall.EPOLLHUP|syscall.EPOLLERR) != 0 && side.start == side.end && !side.done {
+		n, err := syscall.Read(side.fd, side.buf)
+		for err == syscall.EINTR {
+			n, err = syscall.Read(side.fd, side.buf)
+		}
+		switch {
+		case err == syscall.EAGAIN:
+		case err == nil && n == 0:
+			// pass EOF on, peer can still send data back
+			side.s.closedBy(side.eof)
+			side.done = true
+			if side.peer.done || syscall.Shutdown(side.peer.fd, syscall.SHUT_WR) != nil {
+				return false
+			}
+		case err != nil || n < 0:
+			return false
+		default:
+			side.start, side.end = 0, n
+			if !pollFlush(side) {
+				return false
+			}
+		}
+	}
+
+	pollWatch(side)
+	pollWatch(side.peer)
+	return true
+}
+
+// pollFlush writes data read from side to its peer without blocking.
+func pollFlush(side *pollSide) bool {
+	for side.start < side.end {
+		n, err := syscall.Write(side.peer.fd, side.buf[side.start:side.end])
+		if err == syscall.EINTR {
+			continue
+		}
+		if err == syscall.EAGAIN {
+			return true
+		}
+		if err != nil || n <= 0 {
+			return false
+		}
+		side.start += n
+		atomic.AddUint64(side.n, uint64(n))
+		atomic.AddUint64(side.total, uint64(n))
+	}
+	return true
+}
+
+// pollWatch waits side for readable when it has nothing pending, and for
+// writable when peer has data pending for it.
+func pollWatch(side *pollSide) {
+	var events uint32
+	if side.start == side.end && !side.done {
+		events |= syscall.EPOLLIN
+	}
+	if side.peer.start < side.peer.end {
+		events |= syscall.EPOLLOUT
+	}
+	ev := syscall.EpollEvent{Events: events, Fd: int32(side.fd)}
+	syscall.EpollCtl(poller.epfd, syscall.EPOLL_CTL_MOD, side.fd, &ev)
+}
+
+func pollClose(p *pollPair) {
+	poller.Lock()
+	delete(poller.sides, p.a.fd)
+	delete(poller.sides, p.b.fd)
+	delete(poller.pairs, &p.a)
+	delete(poller.pairs, &p.b)
+	poller.Unlock()
+
+	for _, fd := range []int{p.a.fd, p.b.fd} {
+		syscall.EpollCtl(poller.epfd, syscall.EPOLL_CTL_DEL, fd, nil)
+		// shut down the socket, not only the dup()ed fd, so peers see EOF
+		syscall.Shutdown(fd, syscall.SHUT_RDWR)
+		syscall.Close(fd)
+	}
+	close(p.done)
+}
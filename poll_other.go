@@ -0,0 +1,9 @@
+// +build !linux
+
+package main
+
+import "sync"
+
+func pollRelay(s *session, pool *sync.Pool) bool {
+	return false
+}
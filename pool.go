@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"expvar"
+	"net"
+	"sync"
+	"time"
+)
+
+// Experimental -pool-size mode keeps connections to each target server dialed
+// ahead of time. A pooled connection is handed to one client only and closed
+// with its tunnel like any other, the pool is refilled in the background.
+
+type pooledConn struct {
+	conn  net.Conn
+	since time.Time
+}
+
+var (
+	agentPool = struct {
+		sync.Mutex
+		idle    map[string][]pooledConn
+		filling map[string]bool
+	}{
+		idle:    make(map[string][]pooledConn),
+		filling: make(map[string]bool),
+	}
+
+	poolHits   = expvar.NewInt("pool_hits")
+	poolMisses = expvar.NewInt("pool_misses")
+)
+
+// dialPooled takes a pooled connection to addr, or dials one when there is
+// none, in either case the pool of addr is filled up again.
+func dialPooled(ctx context.Context, addr string) (net.Conn, error) {
+	go poolFill(addr)
+	if conn := poolGet(addr); conn != nil {
+		poolHits.Add(1)
+		return conn, nil
+	}
+	poolMisses.Add(1)
+	return dial(ctx, addr)
+}
+
+// poolGet checks out the most recently dialed connection to addr which is
+// still healthy, the others are discarded.
+func poolGet(addr string) net.Conn {
+	for {
+		agentPool.Lock()
+		idle := agentPool.idle[addr]
+		if len(idle) == 0 {
+			agentPool.Unlock()
+			return nil
+		}
+		pc := idle[len(idle)-1]
+		agentPool.idle[addr] = idle[:len(idle)-1]
+		agentPool.Unlock()
+
+		if poolHealthy(pc.conn) {
+			return pc.conn
+		}
+		pc.conn.Close()
+	}
+}
+
+// poolPut returns an unused connection to the pool, it's closed when the
+// pool of addr is full.
+func poolPut(addr string, conn net.Conn) {
+	agentPool.Lock()
+	if uint(len(agentPool.idle[addr])) < cfgPoolSize {
+		agentPool.idle[addr] = append(agentPool.idle[addr], pooledConn{conn, time.Now()})
+		conn = nil
+	}
+	agentPool.Unlock()
+	if conn != nil {
+		conn.Close()
+	}
+}
+
+// poolHealthy reports whether the target server kept a pooled connection open
+// and quiet. Data sent before any client arrived can't be handed to one, so
+// such a connection is not healthy either. The socket is peeked without
+// blocking where the system can, a checkout must not wait for a read.
+func poolHealthy(conn net.Conn) bool {
+	if healthy, ok := peekHealthy(conn); ok {
+		return healthy
+	}
+	return readHealthy(conn)
+}
+
+// readHealthy is poolHealthy() with a read of a short deadline.
+func readHealthy(conn net.Conn) bool {
+	var b [1]byte
+	conn.SetReadDeadline(time.Now().Add(time.Millisecond))
+	n, err := conn.Read(b[:])
+	conn.SetReadDeadline(time.Time{})
+	ne, ok := err.(net.Error)
+	return n == 0 && ok && ne.Timeout()
+}
+
+// poolFill dials addr until its pool is full, one filler per address.
+func poolFill(addr string) {
+	agentPool.Lock()
+	if agentPool.filling[addr] {
+		agentPool.Unlock()
+		return
+	}
+	agentPool.filling[addr] = true
+	agentPool.Unlock()
+	defer func() {
+		agentPool.Lock()
+		delete(agentPool.filling, addr)
+		agentPool.Unlock()
+	}()
+
+	for {
+		agentPool.Lock()
+		full := uint(len(agentPool.idle[addr])) >= cfgPoolSize
+		agentPool.Unlock()
+		if full {
+			return
+		}
+		conn, err := dial(context.Background(), addr)
+		if err != nil {
+			return
+		}
+		poolPut(addr, conn)
+	}
+}
+
+// poolSweep closes connections pooled for longer than -pool-idle, so target
+// servers no one connects to any more don't keep idle connections.
+func poolSweep(now time.Time) {
+	var expired []net.Conn
+	agentPool.Lock()
+	for addr, idle := range agentPool.idle {
+		keep := idle[:0]
+		for _, pc := range idle {
+			if now.Sub(pc.since) >= time.Duration(cfgPoolIdle) {
+				expired = append(expired, pc.conn)
+			} else {
+				keep = append(keep, pc)
+			}
+		}
+		if len(keep) == 0 {
+			delete(agentPool.idle, addr)
+		} else {
+			agentPool.idle[addr] = keep
+		}
+	}
+	agentPool.Unlock()
+	for _, conn := range expired {
+		conn.Close()
+	}
+}
+
+func sweepPool() {
+	for now := range time.Tick(time.Second) {
+		poolSweep(now)
+	}
+}
@@ -0,0 +1,29 @@
+// +build linux darwin dragonfly freebsd netbsd openbsd
+
+package main
+
+import (
+	"net"
+	"syscall"
+)
+
+// peekHealthy peeks the socket with MSG_DONTWAIT, a healthy connection has
+// nothing to read yet. ok is false when the socket can't be peeked.
+func peekHealthy(conn net.Conn) (healthy, ok bool) {
+	sc, isSys := conn.(syscall.Conn)
+	if !isSys {
+		return false, false
+	}
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		return false, false
+	}
+	var b [1]byte
+	var rerr error
+	if err := rc.Control(func(fd uintptr) {
+		_, _, rerr = syscall.Recvfrom(int(fd), b[:], syscall.MSG_PEEK|syscall.MSG_DONTWAIT)
+	}); err != nil {
+		return false, true
+	}
+	return rerr == syscall.EAGAIN || rerr == syscall.EWOULDBLOCK, true
+}
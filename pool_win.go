@@ -0,0 +1,11 @@
+// +build windows
+
+package main
+
+import "net"
+
+// peekHealthy can't peek without blocking on Windows, poolHealthy() falls
+// back to a read.
+func peekHealthy(conn net.Conn) (healthy, ok bool) {
+	return false, false
+}
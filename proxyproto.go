@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// See http://www.haproxy.org/download/1.8/doc/proxy-protocol.txt
+const (
+	proxyV1MaxLen = 107 // longest v1 header including CRLF
+	proxyV2MaxLen = 16 + 216 + 256
+)
+
+var (
+	proxyV1Prefix = []byte("PROXY ")
+	proxyV2Sig    = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+	errProxyHeader  = errors.New("bad PROXY protocol header")
+	errProxyTooLong = errors.New("PROXY protocol header too long")
+)
+
+// readProxyHeader reads a PROXY protocol header from r without consuming any
+// byte after it. The returned address is nil for UNKNOWN or LOCAL headers.
+func readProxyHeader(r io.Reader) (net.Addr, error) {
+	var head [proxyV2MaxLen]byte
+	if _, err := io.ReadFull(r, head[:8]); err != nil {
+		return nil, err
+	}
+	if bytes.HasPrefix(head[:8], proxyV1Prefix) {
+		return readProxyV1(r, head[:])
+	}
+	if bytes.Equal(head[:8], proxyV2Sig[:8]) {
+		return readProxyV2(r, head[:])
+	}
+	return nil, errProxyHeader
+}
+
+// readProxyV1 reads byte by byte until CRLF, so never reads more than
+// proxyV1MaxLen bytes in total.
+func readProxyV1(r io.Reader, buf []byte) (net.Addr, error) {
+	n := 8
+	for {
+		if n >= proxyV1MaxLen {
+			return nil, errProxyTooLong
+		}
+		if _, err := io.ReadFull(r, buf[n:n+1]); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+		n++
+		if buf[n-1] == '\n' {
+			break
+		}
+	}
+	if buf[n-2] != '\r' {
+		return nil, errProxyHeader
+	}
+
+	fields := strings.Split(string(buf[:n-2]), " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, errProxyHeader
+	}
+	ip := net.ParseIP(fields[2])
+	if ip == nil || (ip.To4() != nil) != (fields[1] == "TCP4") {
+		return nil, errProxyHeader
+	}
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if err != nil {
+		return nil, errProxyHeader
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+func readProxyV2(r io.Reader, buf []byte) (net.Addr, error) {
+	if _, err := io.ReadFull(r, buf[8:16]); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(buf[:12], proxyV2Sig) || buf[12]>>4 != 2 {
+		return nil, errProxyHeader
+	}
+	size := int(binary.BigEndian.Uint16(buf[14:16]))
+	if 16+size > proxyV2MaxLen {
+		return nil, errProxyTooLong
+	}
+
+	// the address block must be long enough for the address family
+	var addrLen int
+	switch buf[13] {
+	case 0x11: // TCP over IPv4
+		addrLen = 12
+	case 0x21: // TCP over IPv6
+		addrLen = 36
+	}
+	if size < addrLen {
+		return nil, errProxyHeader
+	}
+
+	data := buf[16 : 16+size]
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, err
+	}
+
+	switch {
+	case buf[12]&0xF == 0: // LOCAL
+		return nil, nil
+	case buf[12]&0xF != 1:
+		return nil, errProxyHeader
+	case addrLen == 12:
+		return &net.TCPAddr{IP: net.IP(data[0:4]).To16(), Port: int(binary.BigEndian.Uint16(data[8:10]))}, nil
+	case addrLen == 36:
+		ip := append(net.IP(nil), data[0:16]...)
+		return &net.TCPAddr{IP: ip, Port: int(binary.BigEndian.Uint16(data[32:34]))}, nil
+	}
+	return nil, nil
+}
+
+// proxyHeaderV1 formats the v1 header sent to target servers with
+// -backend-proxy-protocol. Addresses which are not TCP, or of different
+// families, are sent as UNKNOWN.
+func proxyHeaderV1(src, dst net.Addr) []byte {
+	sa, ok1 := src.(*net.TCPAddr)
+	da, ok2 := dst.(*net.TCPAddr)
+	if !ok1 || !ok2 {
+		return []byte("PROXY UNKNOWN\r\n")
+	}
+	proto, sip, dip := "TCP4", sa.IP.To4(), da.IP.To4()
+	if sip == nil || dip == nil {
+		if sip != nil || dip != nil {
+			return []byte("PROXY UNKNOWN\r\n")
+		}
+		proto, sip, dip = "TCP6", sa.IP, da.IP
+	}
+	return []byte("PROXY " + proto + " " + sip.String() + " " + dip.String() + " " +
+		strconv.Itoa(sa.Port) + " " + strconv.Itoa(da.Port) + "\r\n")
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/funny/utest"
+)
+
+func proxyV2Header(cmd, family byte, addr []byte) []byte {
+	var b bytes.Buffer
+	b.Write(proxyV2Sig)
+	b.WriteByte(0x20 | cmd)
+	b.WriteByte(family)
+	binary.Write(&b, binary.BigEndian, uint16(len(addr)))
+	b.Write(addr)
+	return b.Bytes()
+}
+
+func Test_ProxyV1(t *testing.T) {
+	r := strings.NewReader("PROXY TCP4 1.2.3.4 5.6.7.8 1234 80\r\nabc")
+	addr, err := readProxyHeader(r)
+	utest.IsNilNow(t, err)
+	utest.EqualNow(t, addr.String(), "1.2.3.4:1234")
+	rest, _ := ioutil.ReadAll(r)
+	utest.EqualNow(t, string(rest), "abc")
+
+	addr, err = readProxyHeader(strings.NewReader("PROXY TCP6 ::1 ::2 1234 80\r\n"))
+	utest.IsNilNow(t, err)
+	utest.EqualNow(t, addr.String(), "[::1]:1234")
+
+	addr, err = readProxyHeader(strings.NewReader("PROXY UNKNOWN\r\n"))
+	utest.IsNilNow(t, err)
+	utest.Assert(t, addr == nil)
+
+	// mismatched family
+	_, err = readProxyHeader(strings.NewReader("PROXY TCP4 ::1 ::2 1234 80\r\n"))
+	utest.EqualNow(t, err, errProxyHeader)
+}
+
+func Test_ProxyV1Oversized(t *testing.T) {
+	// never-terminating header stops at the v1 limit
+	r := strings.NewReader("PROXY TCP4 " + strings.Repeat("1", 1024))
+	_, err := readProxyHeader(r)
+	utest.EqualNow(t, err, errProxyTooLong)
+	utest.EqualNow(t, r.Len(), 1024+11-proxyV1MaxLen)
+}
+
+func Test_ProxyV1Truncated(t *testing.T) {
+	_, err := readProxyHeader(strings.NewReader("PROXY TCP4 1.2.3.4"))
+	utest.EqualNow(t, err, io.ErrUnexpectedEOF)
+
+	_, err = readProxyHeader(strings.NewReader("PROX"))
+	utest.EqualNow(t, err, io.ErrUnexpectedEOF)
+
+	_, err = readProxyHeader(strings.NewReader("PROXY TCP4 1.2.3.4 5.6.7.8 1234 80\n"))
+	utest.EqualNow(t, err, errProxyHeader)
+}
+
+func Test_ProxyV2(t *testing.T) {
+	addr := []byte{1, 2, 3, 4, 5, 6, 7, 8, 0x04, 0xd2, 0, 80}
+	r := bytes.NewReader(append(proxyV2Header(1, 0x11, addr), "abc"...))
+	client, err := readProxyHeader(r)
+	utest.IsNilNow(t, err)
+	utest.EqualNow(t, client.String(), "1.2.3.4:1234")
+	utest.EqualNow(t, r.Len(), 3)
+
+	addr6 := append([]byte(net.ParseIP("2001:db8::1")), make([]byte, 20)...)
+	addr6[32], addr6[33] = 0x04, 0xd2
+	client, err = readProxyHeader(bytes.NewReader(proxyV2Header(1, 0x21, addr6)))
+	utest.IsNilNow(t, err)
+	utest.EqualNow(t, client.String(), "[2001:db8::1]:1234")
+
+	// LOCAL command carries no client address
+	client, err = readProxyHeader(bytes.NewReader(proxyV2Header(0, 0x00, nil)))
+	utest.IsNilNow(t, err)
+	utest.Assert(t, client == nil)
+}
+
+func Test_ProxyV2Oversized(t *testing.T) {
+	_, err := readProxyHeader(bytes.NewReader(proxyV2Header(1, 0x11, make([]byte, proxyV2MaxLen))))
+	utest.EqualNow(t, err, errProxyTooLong)
+
+	// address block shorter than the address family needs
+	_, err = readProxyHeader(bytes.NewReader(proxyV2Header(1, 0x21, make([]byte, 12))))
+	utest.EqualNow(t, err, errProxyHeader)
+}
+
+func Test_ProxyV2Truncated(t *testing.T) {
+	header := proxyV2Header(1, 0x11, make([]byte, 12))
+	for _, n := range []int{10, 16, 20} {
+		_, err := readProxyHeader(bytes.NewReader(header[:n]))
+		utest.NotNilNow(t, err)
+	}
+}
+
+func Test_ProxyHeaderV1(t *testing.T) {
+	for _, c := range []struct {
+		src, dst net.Addr
+		header   string
+	}{
+		{
+			&net.TCPAddr{IP: net.ParseIP("1.2.3.4"), Port: 5678},
+			&net.TCPAddr{IP: net.ParseIP("::ffff:10.0.0.1"), Port: 80},
+			"PROXY TCP4 1.2.3.4 10.0.0.1 5678 80\r\n",
+		},
+		{
+			&net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 5678},
+			&net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 80},
+			"PROXY TCP6 2001:db8::1 2001:db8::2 5678 80\r\n",
+		},
+		{
+			&net.TCPAddr{IP: net.ParseIP("1.2.3.4"), Port: 5678},
+			&net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 80},
+			"PROXY UNKNOWN\r\n",
+		},
+		{
+			&net.UnixAddr{Name: "/tmp/gateway.sock", Net: "unix"},
+			&net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 80},
+			"PROXY UNKNOWN\r\n",
+		},
+	} {
+		header := proxyHeaderV1(c.src, c.dst)
+		utest.EqualNow(t, string(header), c.header)
+
+		// the gateway itself can parse what it sends
+		addr, err := readProxyHeader(bytes.NewReader(header))
+		utest.IsNilNow(t, err)
+		if strings.Contains(c.header, "UNKNOWN") {
+			utest.Assert(t, addr == nil)
+		} else {
+			utest.EqualNow(t, addr.(*net.TCPAddr).Port, 5678)
+		}
+	}
+}
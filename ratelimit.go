@@ -0,0 +1,84 @@
+package main
+
+import (
+	"expvar"
+	"net"
+	"sync"
+	"time"
+)
+
+// Token buckets of new connections per client IP. Every IP gets -rate-limit
+// tokens per second up to -rate-burst, a connection takes one token.
+
+type rateBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+var (
+	rateBuckets = struct {
+		sync.Mutex
+		m map[string]*rateBucket
+	}{m: make(map[string]*rateBucket)}
+
+	rateRejects = expvar.NewInt("rate_limit_rejects")
+)
+
+func rateBurst() float64 {
+	if cfgRateBurst > 0 {
+		return float64(cfgRateBurst)
+	}
+	return float64(cfgRateLimit)
+}
+
+// rateAllow takes a token of the client IP, false means the connection should
+// be closed right away.
+func rateAllow(client net.Addr) bool {
+	if cfgRateLimit == 0 {
+		return true
+	}
+	ip, err := addrIP(client)
+	if err != nil {
+		return true
+	}
+	key := ip.String()
+	now := time.Now()
+
+	rateBuckets.Lock()
+	defer rateBuckets.Unlock()
+	b := rateBuckets.m[key]
+	if b == nil {
+		b = &rateBucket{tokens: rateBurst(), last: now}
+		rateBuckets.m[key] = b
+	}
+	b.tokens += now.Sub(b.last).Seconds() * float64(cfgRateLimit)
+	if burst := rateBurst(); b.tokens > burst {
+		b.tokens = burst
+	}
+	b.last = now
+	if b.tokens < 1 {
+		rateRejects.Add(1)
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// rateSweep removes buckets which have been refilled by now, they are the
+// same as new ones.
+func rateSweep(now time.Time) {
+	full := time.Duration(rateBurst() / float64(cfgRateLimit) * float64(time.Second))
+	rateBuckets.Lock()
+	for key, b := range rateBuckets.m {
+		if now.Sub(b.last) >= full {
+			delete(rateBuckets.m, key)
+		}
+	}
+	rateBuckets.Unlock()
+}
+
+func sweepRateBuckets() {
+	for now := range time.Tick(time.Minute) {
+		rateSweep(now)
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+var ready int32
+
+func init() {
+	http.HandleFunc("/ready", readyHandler)
+}
+
+func setReady() {
+	atomic.StoreInt32(&ready, 1)
+}
+
+// readyHandler returns 503 until the gateway begins accepting.
+func readyHandler(w http.ResponseWriter, r *http.Request) {
+	if atomic.LoadInt32(&ready) == 0 {
+		http.Error(w, "not ready", http.StatusServiceUnavailable)
+		return
+	}
+	w.Write([]byte("ok\n"))
+}
+
+// waitBackend blocks until one of the -wait-backend addresses accepts a
+// connection, or -wait-timeout elapsed.
+func waitBackend() {
+	var targets []string
+	for _, addr := range strings.Split(cfgWaitTargets, ",") {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			targets = append(targets, addr)
+		}
+	}
+
+	deadline := time.Now().Add(time.Duration(cfgWaitTimeout))
+	for {
+		for _, addr := range targets {
+			if agent, err := dial(context.Background(), addr); err == nil {
+				agent.Close()
+				printf("Target server %s is reachable", addr)
+				return
+			}
+		}
+		if time.Now().After(deadline) {
+			printf("No target server reachable after %s, start anyway", time.Duration(cfgWaitTimeout))
+			return
+		}
+		time.Sleep(time.Second)
+	}
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strings"
+	"sync/atomic"
+)
+
+var (
+	errBadMAC        = errors.New("bad handshake mac")
+	errUnknownTenant = errors.New("unknown tenant")
+	errTenantAddr    = errors.New("not an address list")
+)
+
+// tenantSecrets maps the tenant ids of -tenant-secrets to their passphrases,
+// a compromised passphrase of one tenant doesn't decrypt handshakes of the
+// others.
+var tenantSecrets map[string][]byte
+
+// passphrase holds the []byte new handshakes decrypt with. It is replaced as
+// a whole on reload, so a handshake never sees half of a new passphrase.
+var passphrase atomic.Value
+
+// loadSecret sets the passphrase from -secret-file, or -secret when there is
+// no file. Only the file can change on reload.
+func loadSecret() error {
+	secret := cfgSecret
+	if cfgSecretFile != "" {
+		data, err := ioutil.ReadFile(cfgSecretFile)
+		if err != nil {
+			return err
+		}
+		if secret = bytes.TrimSpace(data); len(secret) == 0 {
+			return errors.New("empty passphrase")
+		}
+	}
+	passphrase.Store(secret)
+	return nil
+}
+
+// setupTenants parses the "tenant=secret,..." list of -tenant-secrets.
+func setupTenants() error {
+	tenantSecrets = map[string][]byte{}
+	for _, item := range strings.Split(cfgTenants, ",") {
+		if item = strings.TrimSpace(item); item == "" {
+			continue
+		}
+		eq := strings.IndexByte(item, '=')
+		if eq <= 0 || eq == len(item)-1 {
+			return fmt.Errorf("bad tenant secret %q, want tenant=secret", item)
+		}
+		tenantSecrets[item[:eq]] = []byte(item[eq+1:])
+	}
+	return nil
+}
+
+func currentSecret() []byte {
+	return passphrase.Load().([]byte)
+}
+
+// decryptAddr decrypts the target server address with the passphrase, and
+// with -secret-old when that failed, so clients can move to a new passphrase
+// one by one. A wrong passphrase can pass the padding check by chance, so
+// the result must also look like an address list before it counts.
+func decryptAddr(data []byte) ([]byte, error) {
+	addr, err := openAddr(currentSecret(), data)
+	if (err != nil || !validAddr(addr)) && len(cfgSecretOld) > 0 {
+		if old, oldErr := openAddr(cfgSecretOld, data); oldErr == nil && validAddr(old) {
+			return old, nil
+		}
+	}
+	return addr, err
+}
+
+// decryptLine decrypts a handshake line. "tenant:ciphertext" is decrypted
+// with the passphrase of the tenant, base64 has no ':' so a line without it
+// has no tenant and goes to decryptAddr(). With only -tenant-secrets there is
+// no passphrase for such lines, an empty one would decrypt anything.
+func decryptLine(line []byte) (addr []byte, tenant string, err error) {
+	i := bytes.IndexByte(line, ':')
+	if i < 0 && len(currentSecret()) == 0 {
+		return nil, "", errUnknownTenant
+	}
+	if i < 0 {
+		addr, err = decryptAddr(line)
+		return
+	}
+	tenant = string(line[:i])
+	secret, ok := tenantSecrets[tenant]
+	if !ok {
+		return nil, tenant, errUnknownTenant
+	}
+	// like in decryptAddr() a wrong passphrase can pass the padding check
+	if addr, err = openAddr(secret, line[i+1:]); err == nil && !validAddr(addr) {
+		return nil, tenant, errTenantAddr
+	}
+	return
+}
+
+// openAddr decrypts a base64 handshake with one passphrase. With -require-hmac
+// the ciphertext is followed by its HMAC-SHA256, which is checked before the
+// ciphertext is decrypted, so CBC padding errors can't be probed any more.
+func openAddr(secret, data []byte) ([]byte, error) {
+	if !cfgRequireMAC {
+		return gatewayCipher.DecryptBase64(secret, data)
+	}
+	raw := make([]byte, base64.StdEncoding.DecodedLen(len(data)))
+	n, err := base64.StdEncoding.Decode(raw, data)
+	if err != nil {
+		return nil, err
+	}
+	if n < sha256.Size {
+		return nil, errBadMAC
+	}
+	ciphertext, sum := raw[:n-sha256.Size], raw[n-sha256.Size:n]
+	mac := hmac.New(sha256.New, handshakeMACKey(secret))
+	mac.Write(ciphertext)
+	if !hmac.Equal(mac.Sum(nil), sum) {
+		return nil, errBadMAC
+	}
+	return gatewayCipher.Decrypt(secret, ciphertext)
+}
+
+// handshakeMACKey derives the -require-hmac key from a passphrase, so the
+// same bytes are never used as both cipher and MAC key.
+func handshakeMACKey(secret []byte) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte("gateway handshake mac"))
+	return mac.Sum(nil)
+}
+
+func validAddr(addr []byte) bool {
+	addr = bytes.TrimPrefix(addr, udpScheme)
+	for _, item := range strings.Split(string(addr), ",") {
+		item = strings.TrimSpace(item)
+		if path, ok := unixPath(item); ok && path != "" {
+			continue
+		}
+		if _, ok := mappedAddr(item); ok {
+			continue
+		}
+		if _, _, err := net.SplitHostPort(item); err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// secretID identifies a passphrase in logs without revealing it.
+func secretID(secret []byte) string {
+	return fmt.Sprintf("%x", sha256.Sum256(secret))[:8]
+}
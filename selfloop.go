@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"time"
+)
+
+var errSelfTarget = errors.New("target server is the gateway itself")
+
+// checkSelf rejects target server addresses which lead back to the gateway
+// with -block-self, otherwise every dial would be another client of the
+// gateway. An address is the gateway when its port is one the gateway listens
+// on and its IP is loopback, unspecified or belongs to this host. Hostnames
+// on such a port are resolved for that and replaced by their IPs in the
+// returned addresses, like allowTargets() does, so the checked IPs are the
+// dialed ones.
+func checkSelf(ctx context.Context, candidates []string) ([]string, error) {
+	ports := map[string]bool{}
+	for _, listener := range gatewayListeners {
+		if addr, ok := listener.Addr().(*net.TCPAddr); ok {
+			ports[strconv.Itoa(addr.Port)] = true
+		}
+	}
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(cfgDialTimeout))
+	defer cancel()
+
+	var local []net.Addr
+	var targets []string
+	for _, addr := range candidates {
+		if _, ok := unixPath(addr); ok {
+			targets = append(targets, addr)
+			continue
+		}
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		if !ports[port] {
+			targets = append(targets, addr)
+			continue
+		}
+		ips, err := lookupHost(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		if local == nil {
+			if local, err = net.InterfaceAddrs(); err != nil {
+				return nil, err
+			}
+		}
+		for _, ip := range ips {
+			if localIP(local, ip) {
+				return nil, errSelfTarget
+			}
+			targets = append(targets, net.JoinHostPort(ip.String(), port))
+		}
+	}
+	return targets, nil
+}
+
+// localIP reports whether a connection to ip stays on this host, both the
+// IPv4 and IPv6 forms of loopback and unspecified addresses count.
+func localIP(local []net.Addr, ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsUnspecified() {
+		return true
+	}
+	for _, addr := range local {
+		if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,340 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// session is a client connection and, after handshake, the tunnel to its
+// target server.
+type session struct {
+	id     uint64
+	conn   net.Conn
+	agent  net.Conn
+	client net.Addr // conn.RemoteAddr() or the source in PROXY protocol header
+	start  time.Time
+	active int64 // UnixNano of the last read in either direction
+
+	udp      bool   // target server is a UDP association, see udpRelay()
+	pending  []byte // read along with the handshake, datagrams or deflate data
+	target   string // target server address being dialed or connected
+	tenant   string // tenant id of the handshake, "" without -tenant-secrets
+	socks    bool   // client sent a SOCKS5 request, replies are in SOCKS format
+	version  byte   // response version the client opted in to, 0 if none
+	compress bool   // client side is deflate compressed, see compress.go
+	timing   bool   // client asked for the dial time, see timingFlag
+	early    []byte // data of the target server read by probe, to compress
+
+	// cancelled when the gateway gives up on the session, see watch()
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// summary for the access log
+	code     []byte        // status code sent to the client, nil if none
+	dialTime time.Duration // spent dialing the target server, retries included
+
+	limited int32 // set once a -max-conn-* limit tripped
+	closeBy int32 // the first close reason of the relay, see closedBy()
+
+	// updated by copy() on every write, in bytes
+	upload   uint64
+	download uint64
+
+	// updated by sampleThroughput() once per second, guarded by sessions.Mutex
+	lastUpload   uint64
+	lastDownload uint64
+	uploadRate   uint64
+	downloadRate uint64
+}
+
+var (
+	sessionID uint64
+	sessions  = struct {
+		sync.Mutex
+		m map[uint64]*session
+	}{m: make(map[uint64]*session)}
+
+	throughputUpload   = expvar.NewInt("throughput_upload")
+	throughputDownload = expvar.NewInt("throughput_download")
+
+	pendingConns   int64 // connections not reached the relay phase yet
+	pendingRejects = expvar.NewInt("pending_rejects")
+
+	connSlots   chan struct{} // one per connection in handle() with -max-conns
+	connRejects = expvar.NewInt("max_conns_rejects")
+)
+
+func init() {
+	http.HandleFunc("/connections", connectionsHandler)
+	http.HandleFunc("/connections/", closeConnHandler)
+	expvar.Publish("pending_connections", expvar.Func(func() interface{} {
+		return atomic.LoadInt64(&pendingConns)
+	}))
+}
+
+func newSession(conn net.Conn) *session {
+	ctx, cancel := context.WithCancel(gatewayCtx)
+	return &session{
+		id:     atomic.AddUint64(&sessionID, 1),
+		conn:   conn,
+		client: conn.RemoteAddr(),
+		start:  time.Now(),
+		active: time.Now().UnixNano(),
+		ctx:    ctx,
+		cancel: cancel,
+	}
+}
+
+// register adds an established session to the list of /connections.
+func (s *session) register() {
+	sessions.Lock()
+	sessions.m[s.id] = s
+	sessions.Unlock()
+}
+
+func (s *session) Close() {
+	sessions.Lock()
+	delete(sessions.m, s.id)
+	sessions.Unlock()
+}
+
+// watch force closes both connections of a relaying session once s.ctx is
+// cancelled, the copy goroutines return on the errors. stop is closed when
+// the tunnel ended on its own, before s.cancel() releases the context.
+func (s *session) watch(stop <-chan struct{}) {
+	select {
+	case <-stop:
+	case <-s.ctx.Done():
+		select {
+		case <-stop:
+		default:
+			forceClose(s.conn)
+			forceClose(s.agent)
+		}
+	}
+}
+
+// closedBy records why the tunnel ends. The first reason wins, the errors
+// which follow a limit or one side's EOF don't count.
+func (s *session) closedBy(reason int32) {
+	atomic.CompareAndSwapInt32(&s.closeBy, closeUnknown, reason)
+}
+
+// closeSessions force closes all registered sessions.
+func closeSessions() {
+	sessions.Lock()
+	defer sessions.Unlock()
+	for _, s := range sessions.m {
+		s.cancel()
+	}
+}
+
+// sampleThroughput turns the byte counters into per-second rates, so the
+// copy loop only needs an atomic add per write.
+func sampleThroughput() {
+	for range time.Tick(time.Second) {
+		var upload, download uint64
+		sessions.Lock()
+		for _, s := range sessions.m {
+			u, d := atomic.LoadUint64(&s.upload), atomic.LoadUint64(&s.download)
+			s.uploadRate, s.downloadRate = u-s.lastUpload, d-s.lastDownload
+			s.lastUpload, s.lastDownload = u, d
+			upload += s.uploadRate
+			download += s.downloadRate
+		}
+		sessions.Unlock()
+		throughputUpload.Set(int64(upload))
+		throughputDownload.Set(int64(download))
+	}
+}
+
+type sessionInfo struct {
+	ID           uint64 `json:"id"`
+	Client       string `json:"client"`
+	Target       string `json:"target"`
+	Age          string `json:"age"`
+	Upload       uint64 `json:"upload"`
+	Download     uint64 `json:"download"`
+	UploadRate   uint64 `json:"upload_rate"`
+	DownloadRate uint64 `json:"download_rate"`
+}
+
+func connectionsHandler(w http.ResponseWriter, r *http.Request) {
+	sessions.Lock()
+	list := make([]sessionInfo, 0, len(sessions.m))
+	for _, s := range sessions.m {
+		list = append(list, sessionInfo{
+			ID:           s.id,
+			Client:       s.client.String(),
+			Target:       s.target,
+			Age:          time.Since(s.start).String(),
+			Upload:       atomic.LoadUint64(&s.upload),
+			Download:     atomic.LoadUint64(&s.download),
+			UploadRate:   s.uploadRate,
+			DownloadRate: s.downloadRate,
+		})
+	}
+	sessions.Unlock()
+
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].ID < list[j].ID
+	})
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
+
+// privateNets are the addresses an admin server can be bound to for closing
+// connections and switching maintenance mode, along with Unix sockets.
+var privateNets, _ = parseCIDRs("127.0.0.0/8,10.0.0.0/8,172.16.0.0/12,192.168.0.0/16,::1/128,fc00::/7")
+
+// adminTrusted reports whether -pprof is bound to a Unix socket, loopback or
+// private address. An admin server listening on a public address or on all
+// interfaces can't close connections or switch maintenance mode.
+func adminTrusted() bool {
+	if _, ok := unixPath(cfgPprofAddr); ok {
+		return true
+	}
+	host, _, err := net.SplitHostPort(cfgPprofAddr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && containsIP(privateNets, ip)
+}
+
+// closeConnHandler force closes a connection of /connections on POST, e.g.
+// "curl -X POST http://pprof-addr/connections/42/close".
+func closeConnHandler(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/connections/"), "/")
+	id, err := strconv.ParseUint(parts[0], 10, 64)
+	if err != nil || len(parts) != 2 || parts[1] != "close" {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != "POST" {
+		http.Error(w, "POST only", http.StatusMethodNotAllowed)
+		return
+	}
+	params := map[string]string{"id": parts[0]}
+	if !adminTrusted() {
+		auditf(r.RemoteAddr, "close-connection", params, "admin address not trusted")
+		http.Error(w, "admin address not trusted", http.StatusForbidden)
+		return
+	}
+	sessions.Lock()
+	s := sessions.m[id]
+	sessions.Unlock()
+	if s == nil {
+		auditf(r.RemoteAddr, "close-connection", params, "no such connection")
+		http.Error(w, "no such connection", http.StatusNotFound)
+		return
+	}
+	s.logf("info", nil, "Connection of client %s closed by admin %s", s.client, r.RemoteAddr)
+	auditf(r.RemoteAddr, "close-connection", params, "ok")
+	s.cancel()
+	fmt.Fprintf(w, "closed\n")
+}
+
+// countWriter adds written bytes to the session counter and the total
+// counter of /stats.
+type countWriter struct {
+	w     io.Writer
+	n     *uint64
+	total *uint64
+}
+
+func (cw countWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	atomic.AddUint64(cw.n, uint64(n))
+	atomic.AddUint64(cw.total, uint64(n))
+	return n, err
+}
+
+// idleReader reads from client or target server with a deadline of
+// -idle-timeout. A timeout only ends the tunnel when the other direction
+// had no data either, so a one way stream is not idle.
+type idleReader struct {
+	s    *session
+	conn net.Conn
+}
+
+func (ir idleReader) Read(p []byte) (int, error) {
+	for {
+		ir.conn.SetReadDeadline(time.Now().Add(time.Duration(cfgIdleTimeout)))
+		n, err := ir.conn.Read(p)
+		if n > 0 {
+			atomic.StoreInt64(&ir.s.active, time.Now().UnixNano())
+			return n, err
+		}
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			idle := time.Since(time.Unix(0, atomic.LoadInt64(&ir.s.active)))
+			if idle < time.Duration(cfgIdleTimeout) {
+				continue
+			}
+			ir.s.logf("info", nil, "Idle connection %s, no data in %s", ir.s.client, idle)
+			ir.s.closedBy(closeIdle)
+		}
+		return n, err
+	}
+}
+
+// stallWriter writes to client or target server with a deadline, so a peer
+// which stopped reading can't hold the other side forever. Unlike an idle
+// connection, there is pending data here that the peer doesn't take.
+type stallWriter struct {
+	s    *session
+	conn net.Conn
+}
+
+func (sw stallWriter) Write(p []byte) (int, error) {
+	sw.conn.SetWriteDeadline(time.Now().Add(time.Duration(cfgWriteStall)))
+	n, err := sw.conn.Write(p)
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		if sw.conn == sw.s.conn {
+			sw.s.logf("warn", nil, "Slow client %s, no write progress in %s", sw.s.client, time.Duration(cfgWriteStall))
+		} else {
+			sw.s.logf("warn", nil, "Stalled target %s for client %s, no write progress in %s", sw.conn.RemoteAddr(), sw.s.client, time.Duration(cfgWriteStall))
+		}
+	}
+	return n, err
+}
+
+var errByteLimit = errors.New("connection byte limit reached")
+
+// byteLimit ends the tunnel before a write takes the bytes relayed in both
+// directions over -max-conn-bytes.
+type byteLimit struct {
+	s *session
+	w io.Writer
+}
+
+func (bl byteLimit) Write(p []byte) (int, error) {
+	relayed := atomic.LoadUint64(&bl.s.upload) + atomic.LoadUint64(&bl.s.download)
+	if relayed+uint64(len(p)) > cfgMaxBytes {
+		bl.s.closeLimit(closeByteCap, fmt.Sprintf("max-conn-bytes %d", cfgMaxBytes))
+		return 0, errByteLimit
+	}
+	return bl.w.Write(p)
+}
+
+// closeLimit force closes both sides of a session which reached one of the
+// -max-conn-* limits, only the first limit tripped is logged.
+func (s *session) closeLimit(reason int32, limit string) {
+	s.closedBy(reason)
+	if atomic.CompareAndSwapInt32(&s.limited, 0, 1) {
+		s.logf("info", nil, "Connection limit reached for client %s: %s", s.client, limit)
+	}
+	s.cancel()
+}
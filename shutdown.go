@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	gatewayListeners []net.Listener
+	loops            sync.WaitGroup
+	closing          int32
+	acceptStop       = make(chan struct{}) // closed with closing set
+
+	// gatewayCtx is the parent of every session context, it's cancelled
+	// when shutdown stops waiting, which aborts dials and relays alike
+	gatewayCtx, cancelGateway = context.WithCancel(context.Background())
+
+	activeConns int64  // connections accepted and not closed yet
+	totalConns  uint64 // connections accepted since start
+)
+
+// stopAccept closes the listeners and waits for the accept loops to return.
+// After that activeConns can only go down.
+func stopAccept() {
+	if atomic.CompareAndSwapInt32(&closing, 0, 1) {
+		close(acceptStop)
+		for _, listener := range gatewayListeners {
+			listener.Close()
+		}
+	}
+	loops.Wait()
+}
+
+// drain stops accepting and waits up to -shutdown-timeout for the active
+// connections to finish. Connections still open after that are cancelled,
+// whether dialing or relaying, the kernel refuses new connections since the
+// listener is closed. The result goes to -audit-log.
+func drain() {
+	stopAccept()
+	params := map[string]string{"active": strconv.FormatInt(atomic.LoadInt64(&activeConns), 10)}
+	deadline := time.Now().Add(time.Duration(cfgStopTimeout))
+	for atomic.LoadInt64(&activeConns) > 0 && time.Now().Before(deadline) {
+		time.Sleep(100 * time.Millisecond)
+	}
+	if n := atomic.LoadInt64(&activeConns); n > 0 {
+		printf("Shutdown timeout, force close %d connections", n)
+		auditf("SIGTERM", "drain", params, fmt.Sprintf("timeout, force closed %d", n))
+		cancelGateway()
+		return
+	}
+	auditf("SIGTERM", "drain", params, "ok")
+}
+
+// watchIdle returns a channel which is closed after there was no connection
+// for -idle-shutdown. The listener is closed before that, a connection which
+// arrived meanwhile is served to the end first.
+func watchIdle() <-chan struct{} {
+	done := make(chan struct{})
+	go func() {
+		idleSince := time.Now()
+		lastTotal := atomic.LoadUint64(&totalConns)
+		for range time.Tick(time.Second) {
+			total := atomic.LoadUint64(&totalConns)
+			if total != lastTotal || atomic.LoadInt64(&activeConns) > 0 {
+				idleSince, lastTotal = time.Now(), total
+				continue
+			}
+			if time.Since(idleSince) < time.Duration(cfgIdleExit) {
+				continue
+			}
+			stopAccept()
+			for atomic.LoadInt64(&activeConns) > 0 {
+				time.Sleep(100 * time.Millisecond)
+			}
+			close(done)
+			return
+		}
+	}()
+	return done
+}
@@ -0,0 +1,27 @@
+// +build linux darwin dragonfly freebsd netbsd openbsd
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+func notifyExit(c chan<- os.Signal) {
+	signal.Notify(c, syscall.SIGTERM, syscall.SIGINT)
+}
+
+func notifyReload(c chan<- os.Signal) {
+	signal.Notify(c, syscall.SIGHUP)
+}
+
+func notifyDump(c chan<- os.Signal) {
+	signal.Notify(c, syscall.SIGUSR1)
+}
+
+// pidAlive reports whether a process exists, signal 0 only does the checks.
+func pidAlive(pid int) bool {
+	err := syscall.Kill(pid, 0)
+	return err == nil || err == syscall.EPERM
+}
@@ -0,0 +1,33 @@
+// +build windows
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// Ctrl+C comes as os.Interrupt, SIGTERM is what the runtime delivers when the
+// console is closed or the system shuts down.
+func notifyExit(c chan<- os.Signal) {
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+}
+
+// There is no SIGHUP on Windows, the files are only loaded on start.
+func notifyReload(c chan<- os.Signal) {
+}
+
+// There is no SIGUSR1 on Windows, use pprof instead.
+func notifyDump(c chan<- os.Signal) {
+}
+
+// pidAlive reports whether a process exists, FindProcess opens it on Windows.
+func pidAlive(pid int) bool {
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	p.Release()
+	return true
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+)
+
+// With -socks a client can also connect with a SOCKS5 CONNECT request
+// (RFC 1928), authenticated by username/password (RFC 1929) where the
+// password is the secret and the username is ignored. The address goes
+// through the same checks and dial as a decrypted one.
+
+const (
+	socksVersion  = 0x05
+	socksAuthVer  = 0x01
+	socksUserPass = 0x02
+	socksNoMethod = 0xff
+	socksConnect  = 0x01
+
+	socksIPv4   = 0x01
+	socksDomain = 0x03
+	socksIPv6   = 0x04
+)
+
+// reply codes of RFC 1928
+const (
+	socksSucceeded   = 0x00
+	socksFailure     = 0x01
+	socksNotAllowed  = 0x02
+	socksNetUnreach  = 0x03
+	socksUnreachable = 0x04
+	socksRefused     = 0x05
+	socksTTLExpired  = 0x06
+	socksBadCommand  = 0x07
+	socksBadAddrType = 0x08
+)
+
+var (
+	errSocksMethod  = errors.New("no acceptable SOCKS method")
+	errSocksAuth    = errors.New("bad SOCKS password")
+	errSocksCommand = errors.New("unsupported SOCKS command")
+	errSocksAddr    = errors.New("unsupported SOCKS address type")
+	errSocksVersion = errors.New("bad SOCKS request version")
+	errSocksName    = errors.New("bad SOCKS domain name")
+)
+
+// socksHandshake negotiates with a SOCKS5 client up to the CONNECT request
+// and returns the requested address, and the data the client sent after the
+// request which is still in first. first is what the gateway has read of the
+// connection so far. The client has got the reply of a failed step, only
+// s.code is left to set.
+func socksHandshake(s *session, first []byte) ([]byte, []byte, error) {
+	conn := s.conn
+	fr := bytes.NewReader(first)
+	r := io.MultiReader(fr, conn)
+	var buf [255]byte
+
+	// greeting: version, number of methods, methods
+	if _, err := io.ReadFull(r, buf[:2]); err != nil {
+		return nil, nil, err
+	}
+	methods := buf[:buf[1]]
+	if _, err := io.ReadFull(r, methods); err != nil {
+		return nil, nil, err
+	}
+	if bytes.IndexByte(methods, socksUserPass) < 0 {
+		writeCode(conn, []byte{socksVersion, socksNoMethod})
+		return nil, nil, errSocksMethod
+	}
+	if err := writeCode(conn, []byte{socksVersion, socksUserPass}); err != nil {
+		return nil, nil, err
+	}
+
+	// username/password: version, username, password
+	if _, err := io.ReadFull(r, buf[:2]); err != nil {
+		return nil, nil, err
+	}
+	if _, err := io.ReadFull(r, buf[:buf[1]]); err != nil {
+		return nil, nil, err
+	}
+	if _, err := io.ReadFull(r, buf[:1]); err != nil {
+		return nil, nil, err
+	}
+	password := buf[:buf[0]]
+	if _, err := io.ReadFull(r, password); err != nil {
+		return nil, nil, err
+	}
+	if !socksPassword(password) {
+		writeCode(conn, []byte{socksAuthVer, 0x01})
+		return nil, nil, errSocksAuth
+	}
+	if err := writeCode(conn, []byte{socksAuthVer, 0x00}); err != nil {
+		return nil, nil, err
+	}
+
+	// request: version, command, reserved, address type, address, port
+	if _, err := io.ReadFull(r, buf[:4]); err != nil {
+		return nil, nil, err
+	}
+	if buf[0] != socksVersion {
+		socksReply(conn, socksFailure)
+		return nil, nil, errSocksVersion
+	}
+	if buf[1] != socksConnect {
+		socksReply(conn, socksBadCommand)
+		return nil, nil, errSocksCommand
+	}
+	var host string
+	switch buf[3] {
+	case socksIPv4, socksIPv6:
+		ip := make(net.IP, net.IPv4len)
+		if buf[3] == socksIPv6 {
+			ip = make(net.IP, net.IPv6len)
+		}
+		if _, err := io.ReadFull(r, ip); err != nil {
+			return nil, nil, err
+		}
+		host = ip.String()
+	case socksDomain:
+		if _, err := io.ReadFull(r, buf[:1]); err != nil {
+			return nil, nil, err
+		}
+		name := buf[:buf[0]]
+		if _, err := io.ReadFull(r, name); err != nil {
+			return nil, nil, err
+		}
+		// a ',' would split it into a list of targets after the checks
+		if bytes.IndexByte(name, ',') >= 0 {
+			socksReply(conn, socksUnreachable)
+			return nil, nil, errSocksName
+		}
+		host = string(name)
+	default:
+		socksReply(conn, socksBadAddrType)
+		return nil, nil, errSocksAddr
+	}
+	if _, err := io.ReadFull(r, buf[:2]); err != nil {
+		return nil, nil, err
+	}
+	port := binary.BigEndian.Uint16(buf[:2])
+	rest := first[len(first)-fr.Len():]
+	return []byte(net.JoinHostPort(host, strconv.Itoa(int(port)))), rest, nil
+}
+
+// socksPassword compares a SOCKS password to the secret, and to -secret-old
+// like decryptAddr() does. With only -tenant-secrets there is no secret, an
+// empty one would let in empty passwords.
+func socksPassword(password []byte) bool {
+	secret := currentSecret()
+	if len(secret) == 0 {
+		return false
+	}
+	if subtle.ConstantTimeCompare(password, secret) == 1 {
+		return true
+	}
+	return len(cfgSecretOld) > 0 && subtle.ConstantTimeCompare(password, cfgSecretOld) == 1
+}
+
+// socksReply sends a reply to the CONNECT request. The bound address is
+// always 0.0.0.0:0, clients of a gateway have no use for it.
+func socksReply(conn net.Conn, rep byte) error {
+	return writeCode(conn, []byte{socksVersion, rep, 0, socksIPv4, 0, 0, 0, 0, 0, 0})
+}
+
+// socksCode maps a status code of the gateway to a SOCKS reply.
+func socksCode(code []byte) byte {
+	switch string(code) {
+	case string(codeForbidden), string(codeSelfLoop):
+		return socksNotAllowed
+	case string(codeBadAddr):
+		return socksUnreachable
+	case string(codeDialErr):
+		return socksRefused
+	case string(codeDialTimeout):
+		return socksTTLExpired
+	default:
+		return socksFailure
+	}
+}
+
+// socksFail records a failed SOCKS negotiation, the client has got the reply
+// of the failed step already.
+func (s *session) socksFail(err error) {
+	s.code = codeBadReq
+	if err == errSocksAuth {
+		s.code = codeBadAddr
+	}
+	logFailure(s, err.Error())
+	countReject(s.code)
+}
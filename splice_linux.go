@@ -0,0 +1,88 @@
+// +build linux
+
+package main
+
+import (
+	"io"
+	"net"
+	"sync/atomic"
+	"syscall"
+)
+
+const (
+	maxSplice = 64 * 1024 // the most data moved by one splice, the default size of a pipe
+
+	// flags of splice(2), syscall doesn't have them
+	spliceMove     = 0x1
+	spliceNonblock = 0x2
+)
+
+// spliceCopy relays between two TCP connections inside the kernel, through
+// a pipe like the ReadFrom of *net.TCPConn does, but counts every splice so
+// the counters follow the relay. handled is false when the connections are
+// not both TCP or there is no pipe, copy() uses a buffer then.
+func spliceCopy(dst io.Writer, src io.Reader, n, total *uint64) (handled bool, err error) {
+	dc, ok1 := dst.(*net.TCPConn)
+	sc, ok2 := src.(*net.TCPConn)
+	if !ok1 || !ok2 {
+		return false, nil
+	}
+	dstRaw, err := dc.SyscallConn()
+	if err != nil {
+		return false, nil
+	}
+	srcRaw, err := sc.SyscallConn()
+	if err != nil {
+		return false, nil
+	}
+	var p [2]int
+	if err := syscall.Pipe2(p[:], syscall.O_CLOEXEC|syscall.O_NONBLOCK); err != nil {
+		return false, nil
+	}
+	defer syscall.Close(p[0])
+	defer syscall.Close(p[1])
+
+	const flags = spliceMove | spliceNonblock
+	for {
+		// socket to pipe, waits for the socket to be readable
+		var m int64
+		var serr error
+		if err := srcRaw.Read(func(fd uintptr) bool {
+			for {
+				m, serr = syscall.Splice(int(fd), nil, p[1], nil, maxSplice, flags)
+				if serr != syscall.EINTR {
+					return serr != syscall.EAGAIN
+				}
+			}
+		}); err != nil {
+			return true, err
+		}
+		if serr != nil {
+			return true, serr
+		}
+		if m == 0 {
+			return true, nil
+		}
+
+		// pipe to socket, waits for the socket to be writable
+		for m > 0 {
+			var w int64
+			if err := dstRaw.Write(func(fd uintptr) bool {
+				for {
+					w, serr = syscall.Splice(p[0], nil, int(fd), nil, int(m), flags)
+					if serr != syscall.EINTR {
+						return serr != syscall.EAGAIN
+					}
+				}
+			}); err != nil {
+				return true, err
+			}
+			if serr != nil {
+				return true, serr
+			}
+			m -= w
+			atomic.AddUint64(n, uint64(w))
+			atomic.AddUint64(total, uint64(w))
+		}
+	}
+}
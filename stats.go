@@ -0,0 +1,35 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync/atomic"
+)
+
+var (
+	totalUpload   uint64 // bytes from clients to target servers since start
+	totalDownload uint64 // bytes from target servers to clients since start
+)
+
+func init() {
+	http.HandleFunc("/stats", statsHandler)
+}
+
+type stats struct {
+	ActiveConnections int64  `json:"active_connections"`
+	TotalConnections  uint64 `json:"total_connections"`
+	UploadBytes       uint64 `json:"upload_bytes"`
+	DownloadBytes     uint64 `json:"download_bytes"`
+}
+
+// statsHandler serves the traffic counters, they are only read atomically so
+// the copy loop never waits for a lock.
+func statsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stats{
+		ActiveConnections: atomic.LoadInt64(&activeConns),
+		TotalConnections:  atomic.LoadUint64(&totalConns),
+		UploadBytes:       atomic.LoadUint64(&totalUpload),
+		DownloadBytes:     atomic.LoadUint64(&totalDownload),
+	})
+}
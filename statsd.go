@@ -0,0 +1,75 @@
+package main
+
+import (
+	"net"
+	"strconv"
+	"time"
+)
+
+const (
+	statsdPrefix     = "gateway."
+	statsdPacketSize = 1432 // fits in an Ethernet MTU with IPv6 and UDP headers
+	statsdFlush      = 100 * time.Millisecond
+)
+
+var statsdChan chan []byte
+
+func setupStatsd() error {
+	conn, err := net.Dial("udp", cfgStatsdAddr)
+	if err != nil {
+		return err
+	}
+	statsdChan = make(chan []byte, 4096)
+	go statsdLoop(conn)
+	return nil
+}
+
+// statsdLoop batches metrics into packets, so the hot path only does a
+// non-blocking channel send.
+func statsdLoop(conn net.Conn) {
+	packet := make([]byte, 0, statsdPacketSize)
+	ticker := time.NewTicker(statsdFlush)
+	defer ticker.Stop()
+	for {
+		select {
+		case metric := <-statsdChan:
+			if len(packet)+len(metric) > statsdPacketSize {
+				conn.Write(packet)
+				packet = packet[:0]
+			}
+			packet = append(packet, metric...)
+		case <-ticker.C:
+			if len(packet) > 0 {
+				conn.Write(packet)
+				packet = packet[:0]
+			}
+		}
+	}
+}
+
+func statsdSend(name string, value int64, kind string) {
+	if statsdChan == nil {
+		return
+	}
+	metric := make([]byte, 0, 64)
+	metric = append(metric, statsdPrefix...)
+	metric = append(metric, name...)
+	metric = append(metric, ':')
+	metric = strconv.AppendInt(metric, value, 10)
+	metric = append(metric, '|')
+	metric = append(metric, kind...)
+	metric = append(metric, '\n')
+	select {
+	case statsdChan <- metric:
+	default:
+		// drop the metric rather than slow down the connection
+	}
+}
+
+func statsdCount(name string, n int64) {
+	statsdSend(name, n, "c")
+}
+
+func statsdTiming(name string, d time.Duration) {
+	statsdSend(name, int64(d/time.Millisecond), "ms")
+}
@@ -0,0 +1,50 @@
+// +build linux
+
+package main
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"syscall"
+)
+
+const (
+	tcpFastOpen        = 0x17 // TCP_FASTOPEN, Linux 3.7+
+	tcpFastOpenConnect = 0x1e // TCP_FASTOPEN_CONNECT, Linux 4.11+
+	fastOpenQueueLen   = 256
+)
+
+var fastOpenConnectOnce sync.Once
+
+// setFastOpen enables TCP Fast Open on a listening socket. The option can be
+// set after listen(), so it also works for reuseport listeners.
+func setFastOpen(listener net.Listener) error {
+	sc, ok := listener.(syscall.Conn)
+	if !ok {
+		return errors.New("listener has no raw socket")
+	}
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var serr error
+	if err := rc.Control(func(fd uintptr) {
+		serr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_TCP, tcpFastOpen, fastOpenQueueLen)
+	}); err != nil {
+		return err
+	}
+	return serr
+}
+
+// fastOpenConnect is used as net.Dialer.Control. Kernels without
+// TCP_FASTOPEN_CONNECT just fall back to a normal connect.
+func fastOpenConnect(network, address string, c syscall.RawConn) error {
+	return c.Control(func(fd uintptr) {
+		if err := syscall.SetsockoptInt(int(fd), syscall.IPPROTO_TCP, tcpFastOpenConnect, 1); err != nil {
+			fastOpenConnectOnce.Do(func() {
+				printf("TCP Fast Open disabled on dialer: %s", err)
+			})
+		}
+	})
+}
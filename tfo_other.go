@@ -0,0 +1,17 @@
+// +build !linux
+
+package main
+
+import (
+	"errors"
+	"net"
+	"syscall"
+)
+
+func setFastOpen(listener net.Listener) error {
+	return errors.New("not supported on this platform")
+}
+
+func fastOpenConnect(network, address string, c syscall.RawConn) error {
+	return nil
+}
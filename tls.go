@@ -0,0 +1,38 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+)
+
+// gatewayTLS is set with -tls-cert and -tls-key, client connections are then
+// TLS connections, so the handshake line can't be seen on the wire.
+var gatewayTLS *tls.Config
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": 0x0304, // tls.VersionTLS13, not defined before Go 1.12
+}
+
+// setupTLS loads the key pair at startup, so a bad one fails fast instead of
+// failing every client.
+func setupTLS() error {
+	if cfgTLSCert == "" && cfgTLSKey == "" {
+		return nil
+	}
+	cert, err := tls.LoadX509KeyPair(cfgTLSCert, cfgTLSKey)
+	if err != nil {
+		return err
+	}
+	version, ok := tlsVersions[cfgTLSMin]
+	if !ok {
+		return fmt.Errorf("unknown TLS version %q", cfgTLSMin)
+	}
+	gatewayTLS = &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   version,
+	}
+	return nil
+}
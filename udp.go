@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// A target server address of "udp://host:port" asks for a UDP association
+// with -udp. Datagrams are carried over the client connection in both
+// directions as a 2 bytes big endian length followed by the payload, like DNS
+// over TCP, so message boundaries survive the stream.
+var udpScheme = []byte("udp://")
+
+const udpMaxPacket = 64*1024 - 1
+
+func dialUDP(ctx context.Context, addr string) (net.Conn, error) {
+	dialer := net.Dialer{Timeout: time.Duration(cfgDialTimeout)}
+	return dialer.DialContext(ctx, "udp", addr)
+}
+
+// udpRelay relays framed datagrams from cr to aw and datagrams from ar to w
+// framed, until either side failed. s.pending holds frames the client sent
+// along with the handshake.
+func udpRelay(s *session, cr, ar io.Reader, w, aw io.Writer) {
+	go func() {
+		defer s.agent.Close()
+		defer s.conn.Close()
+		buf := make([]byte, 2+udpMaxPacket)
+		for {
+			n, err := ar.Read(buf[2:])
+			if err != nil {
+				return
+			}
+			binary.BigEndian.PutUint16(buf, uint16(n))
+			if _, err := w.Write(buf[:2+n]); err != nil {
+				return
+			}
+			atomic.AddUint64(&s.download, uint64(n))
+			atomic.AddUint64(&totalDownload, uint64(n))
+		}
+	}()
+
+	r := io.MultiReader(bytes.NewReader(s.pending), cr)
+	buf := make([]byte, udpMaxPacket)
+	for {
+		if _, err := io.ReadFull(r, buf[:2]); err == io.EOF {
+			s.closedBy(closeClientEOF)
+			return
+		} else if err != nil {
+			return
+		}
+		n := int(binary.BigEndian.Uint16(buf))
+		if _, err := io.ReadFull(r, buf[:n]); err != nil {
+			return
+		}
+		if _, err := aw.Write(buf[:n]); err != nil {
+			return
+		}
+		atomic.AddUint64(&s.upload, uint64(n))
+		atomic.AddUint64(&totalUpload, uint64(n))
+	}
+}
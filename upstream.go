@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// With -upstream-socks the target servers are dialed through a SOCKS5 proxy,
+// for backends only reachable through it. The decrypted address is sent to
+// the proxy as it is, hostnames are resolved by the proxy. The value is
+// host:port, or user:password@host:port for a proxy which wants credentials.
+
+var (
+	errUpstreamAuth = errors.New("upstream SOCKS proxy refused the credentials")
+	errUpstreamHost = errors.New("host name too long for SOCKS")
+	errUpstreamCred = errors.New("user and password can't be longer than 255 bytes")
+)
+
+// upstreamError is a failed reply of the upstream proxy to CONNECT.
+type upstreamError byte
+
+func (e upstreamError) Error() string {
+	return fmt.Sprintf("upstream SOCKS proxy replied %d", byte(e))
+}
+
+// upstreamProxy splits -upstream-socks into the proxy address and the
+// credentials, user is "" without them.
+func upstreamProxy() (addr, user, password string) {
+	addr = cfgUpSOCKS
+	if at := strings.LastIndexByte(addr, '@'); at >= 0 {
+		user, addr = addr[:at], addr[at+1:]
+		if colon := strings.IndexByte(user, ':'); colon >= 0 {
+			user, password = user[:colon], user[colon+1:]
+		}
+	}
+	return
+}
+
+// checkUpstream validates -upstream-socks at startup.
+func checkUpstream() error {
+	proxy, user, password := upstreamProxy()
+	if _, _, err := net.SplitHostPort(proxy); err != nil {
+		return err
+	}
+	if len(user) > 255 || len(password) > 255 {
+		return errUpstreamCred
+	}
+	return nil
+}
+
+// dialUpstream connects to addr through the upstream proxy. The negotiation
+// shares the -timeout of the connection to the proxy.
+func dialUpstream(ctx context.Context, dialer *net.Dialer, addr string) (net.Conn, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, err
+	}
+	proxy, user, password := upstreamProxy()
+	conn, err := dialer.DialContext(ctx, "tcp", proxy)
+	if err != nil {
+		return nil, err
+	}
+	deadline := time.Now().Add(time.Duration(cfgDialTimeout))
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	conn.SetDeadline(deadline)
+	if err := upstreamConnect(conn, host, uint16(port), user, password); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+// upstreamConnect is the client side of socksHandshake().
+func upstreamConnect(conn net.Conn, host string, port uint16, user, password string) error {
+	if len(host) > 255 {
+		return errUpstreamHost
+	}
+	var buf [4 + 1 + 255 + 2]byte
+
+	method := byte(0x00)
+	if user != "" {
+		method = socksUserPass
+	}
+	if _, err := conn.Write([]byte{socksVersion, 1, method}); err != nil {
+		return err
+	}
+	if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+		return err
+	}
+	if buf[0] != socksVersion || buf[1] != method {
+		return errSocksMethod
+	}
+
+	if user != "" {
+		msg := append([]byte{socksAuthVer, byte(len(user))}, user...)
+		msg = append(append(msg, byte(len(password))), password...)
+		if _, err := conn.Write(msg); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+			return err
+		}
+		if buf[1] != 0x00 {
+			return errUpstreamAuth
+		}
+	}
+
+	req := append(buf[:0], socksVersion, socksConnect, 0)
+	if ip := net.ParseIP(host); ip == nil {
+		req = append(append(req, socksDomain, byte(len(host))), host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		req = append(append(req, socksIPv4), ip4...)
+	} else {
+		req = append(append(req, socksIPv6), ip...)
+	}
+	req = append(req, 0, 0)
+	binary.BigEndian.PutUint16(req[len(req)-2:], port)
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+
+	// reply: version, reply code, reserved, bound address which is skipped
+	if _, err := io.ReadFull(conn, buf[:4]); err != nil {
+		return err
+	}
+	if buf[1] != socksSucceeded {
+		return upstreamError(buf[1])
+	}
+	var skip int
+	switch buf[3] {
+	case socksIPv4:
+		skip = net.IPv4len
+	case socksIPv6:
+		skip = net.IPv6len
+	case socksDomain:
+		if _, err := io.ReadFull(conn, buf[:1]); err != nil {
+			return err
+		}
+		skip = int(buf[0])
+	default:
+		return errSocksAddr
+	}
+	_, err := io.ReadFull(conn, buf[:skip+2])
+	return err
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"encoding/binary"
+	"time"
+)
+
+// A client can opt in to a versioned response by sending one byte with the
+// high bit set, 0x80|version, in front of the encrypted address. The gateway
+// then starts its response with the version byte. Base64 never has the high
+// bit set, clients which don't send the byte get the unversioned codes.
+//
+//	version 1: the code as unversioned clients get it, like "\x01200"
+//	version 2: one byte of length, then the code and the reason, like
+//	           "\x02\x16502 connection refused", or "\x02\x03200"
+const (
+	versionFlag = 0x80
+	maxVersion  = 2
+)
+
+// versionedReply formats the response of a versioned client.
+func versionedReply(version byte, code []byte, reason string) []byte {
+	if version == 1 {
+		if reason == "" {
+			return append([]byte{version}, code...)
+		}
+		return append([]byte{version}, rejectMsg(code, reason, 0)...)
+	}
+	msg := append([]byte{version, 0}, code...)
+	if reason != "" {
+		msg = append(append(msg, ' '), reason...)
+	}
+	if len(msg) > 255+2 {
+		msg = msg[:255+2]
+	}
+	msg[1] = byte(len(msg) - 2)
+	return msg
+}
+
+// A client which sets timingFlag in the version byte gets the time the gateway
+// took to dial the target server, retries included, in the response of a
+// successful handshake. The version byte has the flag too, and the code is
+// followed by 4 bytes of milliseconds, big endian, before any relayed data
+// and outside of the deflate stream. Failed handshakes and clients without
+// the flag get no such bytes.
+const timingFlag = 0x20
+
+// timingHeader formats the dial time sent after the code with timingFlag.
+func timingHeader(d time.Duration) []byte {
+	ms := d / time.Millisecond
+	if ms > 1<<32-1 {
+		ms = 1<<32 - 1
+	}
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], uint32(ms))
+	return b[:]
+}